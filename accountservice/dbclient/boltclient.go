@@ -6,35 +6,48 @@ import (
 	"fmt"
 	"log"
 	"strconv"
-
-	"github.com/sirupsen/logrus"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/linhnh123/golang-microservices-tutorial/accountservice/model"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 )
 
 type IBoltClient interface {
 	OpenBoltDb()
 	QueryAccount(ctx context.Context, accountId string) (model.Account, error)
+	StoreAccount(ctx context.Context, account model.Account, eventName string) error
+	PendingOutboxEvents(limit int) ([]OutboxEvent, error)
+	MarkOutboxEventSent(sequence uint64) error
 	Seed()
 	Check() bool
 	CloseBoltDb()
 }
 
+// BoltClient keeps the Bolt database open from OpenBoltDb until CloseBoltDb. Bolt handles
+// concurrent transactions on one handle, so requests and the outbox relay share it.
 type BoltClient struct {
+	// Path of the database file, accounts.db if empty.
+	Path   string
 	boltDB *bolt.DB
 }
 
+// OpenBoltDb opens the database, once when the service starts.
 func (bc *BoltClient) OpenBoltDb() {
+	path := bc.Path
+	if path == "" {
+		path = "accounts.db"
+	}
 	var err error
-	bc.boltDB, err = bolt.Open("accounts.db", 0600, nil)
+	bc.boltDB, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("Open DB")
 }
 
+// CloseBoltDb closes the database when the service stops, once nothing uses it any more.
 func (bc *BoltClient) CloseBoltDb() {
 	bc.boltDB.Close()
 	log.Println("Close DB")
@@ -80,12 +93,10 @@ func (bc *BoltClient) QueryAccount(ctx context.Context, accountId string) (model
 	// Tracing
 	span := tracing.StartChildSpanFromContext(ctx, "QueryAccount")
 	defer span.Finish()
+	logger := logging.FromContext(tracing.UpdateContext(ctx, span))
 
 	account := model.Account{}
 
-	bc.OpenBoltDb()
-	defer bc.CloseBoltDb()
-
 	err := bc.boltDB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("AccountBucket"))
 
@@ -99,11 +110,11 @@ func (bc *BoltClient) QueryAccount(ctx context.Context, accountId string) (model
 	})
 
 	if err != nil {
-		logrus.Infoln(err.Error())
+		logger.Infoln(err.Error())
 		return model.Account{}, nil
 	}
 
-	logrus.Infoln("Account found")
+	logger.Infoln("Account found")
 	return account, nil
 }
 
@@ -16,6 +16,21 @@ func (m *MockBoltClient) QueryAccount(ctx context.Context, accountId string) (mo
 	return args.Get(0).(model.Account), args.Error(1)
 }
 
+func (m *MockBoltClient) StoreAccount(ctx context.Context, account model.Account, eventName string) error {
+	args := m.Mock.Called(ctx, account, eventName)
+	return args.Error(0)
+}
+
+func (m *MockBoltClient) PendingOutboxEvents(limit int) ([]OutboxEvent, error) {
+	args := m.Mock.Called(limit)
+	return args.Get(0).([]OutboxEvent), args.Error(1)
+}
+
+func (m *MockBoltClient) MarkOutboxEventSent(sequence uint64) error {
+	args := m.Mock.Called(sequence)
+	return args.Error(0)
+}
+
 func (m *MockBoltClient) OpenBoltDb() {
 
 }
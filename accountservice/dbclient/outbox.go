@@ -0,0 +1,121 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/linhnh123/golang-microservices-tutorial/accountservice/model"
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	commonmodel "github.com/linhnh123/golang-microservices-tutorial/common/model"
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+)
+
+const outboxBucket = "OutboxBucket"
+
+// AccountEventsExchange is where account change events from the outbox are published.
+var AccountEventsExchange = "accountEvents"
+
+// OutboxEvent is a message that has been committed together with an account change but not
+// necessarily published yet. Events are published in Sequence order.
+type OutboxEvent struct {
+	Sequence uint64             `json:"sequence"`
+	Exchange string             `json:"exchange"`
+	Envelope messaging.Envelope `json:"envelope"`
+}
+
+func init() {
+	messaging.RegisterMessageType("AccountChanged", 1, commonmodel.AccountChanged{})
+}
+
+// StoreAccount writes the account and an outbox event describing the change in the same Bolt
+// transaction, so either both are stored or neither is.
+func (bc *BoltClient) StoreAccount(ctx context.Context, account model.Account, eventName string) error {
+	span := tracing.StartChildSpanFromContext(ctx, "StoreAccount")
+	defer span.Finish()
+
+	accountBytes, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	return bc.boltDB.Update(func(tx *bolt.Tx) error {
+		accounts, err := tx.CreateBucketIfNotExists([]byte("AccountBucket"))
+		if err != nil {
+			return err
+		}
+		if err := accounts.Put([]byte(account.Id), accountBytes); err != nil {
+			return err
+		}
+
+		outbox, err := tx.CreateBucketIfNotExists([]byte(outboxBucket))
+		if err != nil {
+			return err
+		}
+		seq, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		// The envelope, and with it the message ID, is created now so that a re-published event
+		// can be recognised as a duplicate by consumers.
+		envelope, err := messaging.NewEnvelope(tracing.UpdateContext(ctx, span), commonmodel.AccountChanged{
+			EventID:   strconv.FormatUint(seq, 10),
+			AccountID: account.Id,
+			EventName: eventName,
+			Created:   time.Now().Format("2006-01-02T15:04:05"),
+		})
+		if err != nil {
+			return err
+		}
+		eventBytes, err := json.Marshal(OutboxEvent{Sequence: seq, Exchange: AccountEventsExchange, Envelope: envelope})
+		if err != nil {
+			return err
+		}
+		return outbox.Put(sequenceKey(seq), eventBytes)
+	})
+}
+
+// PendingOutboxEvents returns up to limit unsent events, oldest first.
+func (bc *BoltClient) PendingOutboxEvents(limit int) ([]OutboxEvent, error) {
+	events := make([]OutboxEvent, 0)
+	err := bc.boltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(outboxBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && len(events) < limit; k, v = c.Next() {
+			event := OutboxEvent{}
+			if err := json.Unmarshal(v, &event); err != nil {
+				return fmt.Errorf("Corrupt outbox event %d: %v", binary.BigEndian.Uint64(k), err)
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// MarkOutboxEventSent deletes a published event from the outbox. Once the broker has confirmed it
+// there is no need to keep it, and keeping it would grow the database without bound.
+func (bc *BoltClient) MarkOutboxEventSent(sequence uint64) error {
+	return bc.boltDB.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(outboxBucket))
+		key := sequenceKey(sequence)
+		if pending == nil || pending.Get(key) == nil {
+			return fmt.Errorf("No outbox event %d", sequence)
+		}
+		return pending.Delete(key)
+	})
+}
+
+// sequenceKey encodes a sequence number big-endian, so Bolt's byte ordering matches numeric order.
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 	"github.com/sirupsen/logrus"
@@ -24,73 +27,188 @@ import (
 
 var appName = "accountservice"
 
+// appConfig is the configuration accountservice needs, validated at startup and on every refresh.
+type appConfig struct {
+	ServerPort      int    `config:"server_port" validate:"required,port"`
+	AmqpServerUrl   string `config:"amqp_server_url" validate:"required,url"`
+	ConfigEventBus  string `config:"config_event_bus" default:"springCloudBus"`
+	ZipkinServerUrl string `config:"zipkin_server_url" validate:"required,url"`
+	// One of the tracing.Exporter constants, with the Zipkin server as endpoint unless set.
+	TraceExporter string `config:"trace_exporter" default:"zipkin" validate:"oneof=zipkin|otel-zipkin|otlp|stdout|file"`
+	TraceEndpoint string `config:"trace_endpoint"`
+	// Trace context formats for HTTP and AMQP headers, see tracing.SetPropagation.
+	TracePropagation []string `config:"trace_propagation" default:"b3multi"`
+	// How new traces are sampled, see tracing.SetSampling.
+	TraceSampler       string   `config:"trace_sampler" default:"always"`
+	TraceSamplerRoutes []string `config:"trace_sampler_routes" default:"/health=never"`
+	LogLevel           string   `config:"log_level" validate:"oneof=trace|debug|info|warn|warning|error|fatal|panic"`
+	LogFormat          string   `config:"log_format" default:"json" validate:"oneof=json|text"`
+}
+
+// The configuration the service started with. It isn't changed by refreshes, use currentConfig.
+var cfg appConfig
+
+// Swapped to a new copy of appConfig by every valid refresh.
+var boundConfig *config.Binding
+
+// currentConfig returns the configuration as of the last valid refresh. It must not be changed.
+func currentConfig() *appConfig {
+	return boundConfig.Get().(*appConfig)
+}
+
+// Flushes the spans that haven't been exported yet.
+var stopTracing = func(ctx context.Context) error { return nil }
+
+// How long in-flight HTTP requests and messages get to finish when the service is stopped.
+var shutdownTimeout = 15 * time.Second
+
 func initializeBoltClient() {
 	service.DBClient = &dbclient.BoltClient{}
 	service.DBClient.OpenBoltDb()
 	service.DBClient.Seed()
-	service.DBClient.CloseBoltDb()
 }
 
 func initializeMessaging() {
-	if !viper.IsSet("amqp_server_url") {
-		panic("Not set 'amqp_server_url'")
+	messaging.Producer = appName
+	service.MessagingClient = messaging.NewMessagingClient(cfg.AmqpServerUrl)
+	service.MessagingClient.ConnectToBroker(cfg.AmqpServerUrl)
+
+	topology, err := messaging.LoadTopology()
+	if err != nil {
+		panic("Could not load broker topology: " + err.Error())
 	}
-	service.MessagingClient = &messaging.MessagingClient{}
-	service.MessagingClient.ConnectToBroker(viper.GetString("amqp_server_url"))
-	service.MessagingClient.Subscribe(viper.GetString("config_event_bus"), "topic", appName, config.HandleRefreshEvent)
+	if err := service.MessagingClient.DeclareTopology(topology); err != nil {
+		panic("Could not declare broker topology: " + err.Error())
+	}
+	service.MessagingClient.Subscribe(cfg.ConfigEventBus, "topic", appName,
+		config.RefreshEventHandler(service.MessagingClient, cfg.ConfigEventBus))
 }
 
 func init() {
-	logrus.SetFormatter(&logrus.TextFormatter{
-		TimestampFormat: "2006-01-02T15:04:05.000",
-		FullTimestamp:   true,
-	})
 	profile := flag.String("profile", "test", "Environment profile")
 	configServerUrl := flag.String("configServerUrl", "http://configserver:8888", "Address to config server")
 	configBranch := flag.String("configBranch", "master", "git branch to fetch configuration from")
+	offline := flag.Bool("offline", false, "Start without loading configuration from the config server")
+	configFile := flag.String("configFile", "", "Local YAML or JSON config file, overridden by the config server")
 
 	flag.Parse()
 
 	viper.Set("profile", *profile)
 	viper.Set("configServerUrl", *configServerUrl)
 	viper.Set("configBranch", *configBranch)
+	viper.Set("offline", *offline)
+	viper.Set("configFile", *configFile)
 }
 
 func main() {
-	log.Printf("Starting %v\n", appName)
-
-	config.LoadConfigurationFromBranch(
-		viper.GetString("configServerUrl"),
-		appName,
-		viper.GetString("profile"),
-		viper.GetString("configBranch"),
-	)
+	logging.Init(appName)
+	logrus.Infof("Starting %v", appName)
+
+	err := config.Load(config.Options{
+		AppName:         appName,
+		Profile:         viper.GetString("profile"),
+		Branch:          viper.GetString("configBranch"),
+		ConfigServerUrl: viper.GetString("configServerUrl"),
+		Offline:         viper.GetBool("offline"),
+		ConfigFile:      viper.GetString("configFile"),
+		Defaults: map[string]interface{}{
+			messaging.TopologyConfigKey + ".exchanges.accountevents.name": dbclient.AccountEventsExchange,
+			messaging.TopologyConfigKey + ".exchanges.accountevents.type": "topic",
+			// Keeps account events until consumers pick them up, the outbox relay won't publish
+			// events that no queue receives.
+			messaging.TopologyConfigKey + ".queues.accountevents.name":         dbclient.AccountEventsExchange,
+			messaging.TopologyConfigKey + ".bindings.accountevents.queue":      dbclient.AccountEventsExchange,
+			messaging.TopologyConfigKey + ".bindings.accountevents.exchange":   dbclient.AccountEventsExchange,
+			messaging.TopologyConfigKey + ".bindings.accountevents.routingKey": "#",
+		},
+	})
+	if err != nil {
+		panic("Couldn't load configuration, cannot start. Terminating. Error: " + err.Error())
+	}
+	if boundConfig, err = config.Bind(&cfg); err != nil {
+		panic("Invalid configuration, cannot start. Terminating. " + err.Error())
+	}
 
+	logging.ManageConfig()
 	initializeBoltClient()
 	initializeMessaging()
 	initializeTracing()
 
 	cb.ConfigureHystrix([]string{"imageservice", "quotes-service"}, service.MessagingClient)
 
-	handleSigterm(func() {
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayStopped := make(chan struct{})
+	go func() {
+		service.RelayOutbox(relayCtx, time.Second)
+		close(relayStopped)
+	}()
+
+	shutdownComplete := handleSigterm(func(ctx context.Context) {
 		cb.Deregister(service.MessagingClient)
-		service.MessagingClient.Close()
+		if err := service.StopWebServer(ctx); err != nil {
+			logrus.Errorf("HTTP server did not shut down cleanly: %v", err)
+		}
+		stopRelay()
+		<-relayStopped
+		if err := service.MessagingClient.Shutdown(ctx); err != nil {
+			logrus.Errorf("Messaging client did not shut down cleanly: %v", err)
+		}
+		// Nothing uses the database once requests and the relay have stopped.
+		service.DBClient.CloseBoltDb()
+		if err := stopTracing(ctx); err != nil {
+			logrus.Errorf("Tracing did not shut down cleanly: %v", err)
+		}
 	})
 
-	service.StartWebServer(viper.GetString("server_port"))
+	if err := service.StartWebServer(strconv.Itoa(cfg.ServerPort)); err != nil {
+		os.Exit(1)
+	}
+	<-shutdownComplete
+	logrus.Infof("%v stopped", appName)
 }
 
 func initializeTracing() {
-	tracing.InitTracing(viper.GetString("zipkin_server_url"), appName)
+	endpoint := cfg.TraceEndpoint
+	if endpoint == "" {
+		endpoint = cfg.ZipkinServerUrl
+	}
+	var err error
+	stopTracing, err = tracing.Init(tracing.Options{ServiceName: appName, Exporter: cfg.TraceExporter, Endpoint: endpoint})
+	if err != nil {
+		logrus.Warnf("Running without tracing: %v", err)
+	}
+	if err := tracing.SetPropagation(tracing.ParseFormats(cfg.TracePropagation)...); err != nil {
+		panic("Invalid trace propagation: " + err.Error())
+	}
+	if err := tracing.SetSampling(cfg.TraceSampler, cfg.TraceSamplerRoutes); err != nil {
+		panic("Invalid trace sampling: " + err.Error())
+	}
+	config.Watch("trace_sampler", func(key string, oldValue interface{}, newValue interface{}) {
+		current := currentConfig()
+		if err := tracing.SetSampling(current.TraceSampler, current.TraceSamplerRoutes); err != nil {
+			logrus.Errorf("Keeping the current trace sampling: %v", err)
+		}
+	})
+	config.WatchString(tracing.PropagationConfigKey, func(oldValue string, newValue string) {
+		if err := tracing.SetPropagation(tracing.ParseFormats(currentConfig().TracePropagation)...); err != nil {
+			logrus.Errorf("Keeping the current trace propagation: %v", err)
+		}
+	})
 }
 
-func handleSigterm(handleExit func()) {
+// handleSigterm runs handleExit once SIGINT or SIGTERM is received, with a context that expires
+// after shutdownTimeout. The returned channel is closed when handleExit has returned.
+func handleSigterm(handleExit func(ctx context.Context)) <-chan struct{} {
+	done := make(chan struct{})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 	go func() {
 		<-c
-		handleExit()
-		os.Exit(1)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		handleExit(ctx)
+		close(done)
 	}()
+	return done
 }
@@ -1,6 +0,0 @@
-package model
-
-type VipNotification struct {
-	AccountId string `json:"accountId"`
-	ReadAt    string `json:"readAt"`
-}
@@ -4,14 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/util"
-	"github.com/sirupsen/logrus"
 
 	internalmodel "github.com/linhnh123/golang-microservices-tutorial/accountservice/model"
 
@@ -45,6 +44,7 @@ func init() {
 	}
 	client.Transport = transport
 	cb.Client = *client
+	messaging.RegisterMessageType("VipNotification", 1, model.VipNotification{})
 	var err error
 	myIP, err = util.ResolveIpFromHostsFile()
 	if err != nil {
@@ -56,11 +56,10 @@ func init() {
 func notifyVIP(ctx context.Context, account internalmodel.Account) {
 	if account.Id == "10000" {
 		go func(account internalmodel.Account) {
-			vipNotification := internalmodel.VipNotification{AccountId: account.Id, ReadAt: time.Now().UTC().String()}
-			data, _ := json.Marshal(vipNotification)
-			err := MessagingClient.PublishOnQueue(data, "vipQueue")
+			vipNotification := model.VipNotification{AccountId: account.Id, ReadAt: time.Now().UTC().String()}
+			err := messaging.PublishTypedOnQueue(ctx, MessagingClient, vipNotification, "vipQueue")
 			if err != nil {
-				log.Println(err.Error())
+				logging.FromContext(ctx).Errorf("Couldn't notify vipservice: %v", err)
 			}
 		}(account)
 	}
@@ -89,6 +88,28 @@ func GetAccount(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// UpdateAccount stores the account in the request body. The account change is published as an
+// AccountChanged event by the outbox relay.
+func UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var accountId = mux.Vars(r)["accountId"]
+
+	account := internalmodel.Account{}
+	if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	account.Id = accountId
+
+	if err := DBClient.StoreAccount(r.Context(), account, "UPDATED"); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error storing account %v: %v", accountId, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := json.Marshal(account)
+	writeJsonResponse(w, http.StatusOK, data)
+}
+
 func getQuote(ctx context.Context) internalmodel.Quote {
 	body, err := cb.CallUsingCircuitBreaker("quotes-service", "http://quotes-service:8080/api/quote?strength=4", "GET")
 	if err == nil {
@@ -164,7 +185,7 @@ func getAccount(ctx context.Context, accountID string) (internalmodel.Account, e
 		json.Unmarshal(body, &accountData)
 		return toAccount(accountData), nil
 	}
-	logrus.Errorf("Error: %v\n", err.Error())
+	logging.FromContext(tracing.UpdateContext(ctx, child)).Errorf("Error getting account data for %v: %v", accountID, err.Error())
 	return internalmodel.Account{}, err
 }
 
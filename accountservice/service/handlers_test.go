@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	cb "github.com/linhnh123/golang-microservices-tutorial/common/circuitbreaker"
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
 
 	"github.com/stretchr/testify/mock"
@@ -24,10 +25,11 @@ var mockRepo = &dbclient.MockBoltClient{}
 var mockMessagingClient = &messaging.MockMessagingClient{}
 
 var anyString = mock.AnythingOfType("string")
-var anyByteArray = mock.AnythingOfType("[]uint8")
+var anyPublishing = mock.AnythingOfType("amqp.Publishing")
 
 func init() {
 	gock.InterceptClient(client)
+	cb.Client = *client // The circuit breaker got a copy of client before it was intercepted
 }
 
 func TestGetAccountWrongPath(t *testing.T) {
@@ -101,10 +103,10 @@ func TestNotificationIsSentForVIPAccount(t *testing.T) {
 		Reply(200).
 		BodyString(`{"quote":"May the source be with you. Always","ipAddress":"10.0.0.5:8080","language":"en"}`)
 
-	mockRepo.On("QueryAccount", "10000").Return(model.Account{Id: "10000", Name: "Person_123"}, nil)
+	mockRepo.On("QueryAccount", mock.Anything, "10000").Return(model.Account{Id: "10000", Name: "Person_123"}, nil)
 	DBClient = mockRepo
 
-	mockMessagingClient.On("PublishOnQueue", anyByteArray, anyString).Return(nil)
+	mockMessagingClient.On("PublishMessageOnQueue", anyPublishing, anyString).Return(nil)
 	MessagingClient = mockMessagingClient
 
 	Convey("Given a HTTP req for a VIP account", t, func() {
@@ -116,7 +118,7 @@ func TestNotificationIsSentForVIPAccount(t *testing.T) {
 			Convey("Then the response should be a 200 and the MessageClient should have been invoked", func() {
 				So(resp.Code, ShouldEqual, 200)
 				time.Sleep(time.Millisecond * 100)
-				So(mockMessagingClient.AssertNumberOfCalls(t, "PublishOnQueue", 1), ShouldBeTrue)
+				So(mockMessagingClient.AssertNumberOfCalls(t, "PublishMessageOnQueue", 1), ShouldBeTrue)
 			})
 		})
 	})
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How many outbox events are read from Bolt per relay run.
+var outboxBatchSize = 100
+
+// RelayOutbox publishes pending outbox events through MessagingClient every interval until ctx is done.
+// An event is only marked sent once the broker has confirmed it, and a failing event is retried before
+// any later event is published, so consumers get every event at least once and in commit order.
+func RelayOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if sent, err := relayPendingEvents(); err != nil {
+			logrus.Errorf("Outbox relay stopped after %v events: %v", sent, err)
+		} else if sent > 0 {
+			logrus.Infof("Outbox relay published %v events", sent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func relayPendingEvents() (int, error) {
+	events, err := DBClient.PendingOutboxEvents(outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, event := range events {
+		err := MessagingClient.PublishMessageConfirmed(event.Envelope.Publishing(), event.Exchange, "topic")
+		if err != nil {
+			return sent, fmt.Errorf("publishing outbox event %v failed: %v", event.Sequence, err)
+		}
+		// If we crash before this, the event is published again on the next run.
+		if err := DBClient.MarkOutboxEventSent(event.Sequence); err != nil {
+			return sent, fmt.Errorf("marking outbox event %v as sent failed: %v", event.Sequence, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/accountservice/dbclient"
+	"github.com/linhnh123/golang-microservices-tutorial/accountservice/model"
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	commonmodel "github.com/linhnh123/golang-microservices-tutorial/common/model"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/mock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func outboxEvents(sequences ...uint64) []dbclient.OutboxEvent {
+	events := make([]dbclient.OutboxEvent, 0)
+	for _, seq := range sequences {
+		events = append(events, dbclient.OutboxEvent{
+			Sequence: seq,
+			Exchange: "accountEvents",
+			Envelope: messaging.Envelope{Type: "AccountChanged", Version: 1, MessageID: fmt.Sprintf("msg-%d", seq)},
+		})
+	}
+	return events
+}
+
+func TestRelayPendingEvents(t *testing.T) {
+	Convey("Given three pending outbox events", t, func() {
+		repo := &dbclient.MockBoltClient{}
+		repo.On("PendingOutboxEvents", outboxBatchSize).Return(outboxEvents(1, 2, 3), nil)
+		repo.On("MarkOutboxEventSent", mock.Anything).Return(nil)
+		DBClient = repo
+
+		Convey("When the broker confirms all of them", func() {
+			published := make([]string, 0)
+			broker := &messaging.MockMessagingClient{}
+			broker.On("PublishMessageConfirmed", mock.Anything, "accountEvents", "topic").
+				Run(func(args mock.Arguments) {
+					published = append(published, args.Get(0).(amqp.Publishing).MessageId)
+				}).Return(nil)
+			MessagingClient = broker
+
+			sent, err := relayPendingEvents()
+
+			Convey("Then they are published in order and marked sent", func() {
+				So(err, ShouldBeNil)
+				So(sent, ShouldEqual, 3)
+				So(published, ShouldResemble, []string{"msg-1", "msg-2", "msg-3"})
+				So(repo.AssertNumberOfCalls(t, "MarkOutboxEventSent", 3), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the broker fails to confirm the second one", func() {
+			broker := &messaging.MockMessagingClient{}
+			broker.On("PublishMessageConfirmed", mock.MatchedBy(func(msg amqp.Publishing) bool {
+				return msg.MessageId == "msg-2"
+			}), mock.Anything, mock.Anything).Return(fmt.Errorf("nack"))
+			broker.On("PublishMessageConfirmed", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			MessagingClient = broker
+
+			sent, err := relayPendingEvents()
+
+			Convey("Then only the first one is marked sent and the rest wait for the next run", func() {
+				So(err, ShouldNotBeNil)
+				So(sent, ShouldEqual, 1)
+				So(repo.AssertNumberOfCalls(t, "MarkOutboxEventSent", 1), ShouldBeTrue)
+				So(repo.AssertCalled(t, "MarkOutboxEventSent", uint64(1)), ShouldBeTrue)
+				So(broker.AssertNumberOfCalls(t, "PublishMessageConfirmed", 2), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+// Run with -race to check that requests and the relay can share the database. boltdb/bolt predates
+// the pointer checks -race turns on, so add -gcflags=all=-d=checkptr=0.
+func TestRelayOutboxWhileStoringAccounts(t *testing.T) {
+	Convey("Given a Bolt database and an in-memory broker", t, func() {
+		dir, err := ioutil.TempDir("", "outbox")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		repo := &dbclient.BoltClient{Path: filepath.Join(dir, "accounts.db")}
+		repo.OpenBoltDb()
+		defer repo.CloseBoltDb()
+		DBClient = repo
+
+		broker := &messaging.InMemoryMessagingClient{}
+		broker.ConnectToBroker(messaging.InMemoryBrokerURL)
+		received := make(chan amqp.Delivery, 100)
+		broker.Subscribe("accountEvents", "topic", "test", func(d amqp.Delivery) {
+			received <- d
+		})
+		MessagingClient = broker
+
+		Convey("When accounts are stored and read while the relay runs", func() {
+			ctx, stopRelay := context.WithCancel(context.Background())
+			relayStopped := make(chan struct{})
+			go func() {
+				RelayOutbox(ctx, time.Millisecond)
+				close(relayStopped)
+			}()
+
+			errs := make(chan error, 40)
+			wg := sync.WaitGroup{}
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 5; j++ {
+						id := strconv.Itoa(10000 + i*5 + j)
+						errs <- repo.StoreAccount(context.Background(), model.Account{Id: id, Name: "Person"}, "UPDATED")
+						_, err := repo.QueryAccount(context.Background(), id)
+						errs <- err
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			published := map[string]amqp.Delivery{}
+			timeout := time.After(5 * time.Second)
+			for len(published) < 20 {
+				select {
+				case d := <-received:
+					published[d.MessageId] = d
+				case <-timeout:
+					t.Fatalf("Only %v of 20 events were published", len(published))
+				}
+			}
+			stopRelay()
+			<-relayStopped
+
+			Convey("Then every store succeeds and every event is relayed", func() {
+				for err := range errs {
+					So(err, ShouldBeNil)
+				}
+				So(len(published), ShouldEqual, 20)
+				pending, err := repo.PendingOutboxEvents(outboxBatchSize)
+				So(err, ShouldBeNil)
+				So(pending, ShouldBeEmpty)
+			})
+
+			Convey("Then every event says which account changed", func() {
+				accountIDs := map[string]bool{}
+				for _, d := range published {
+					envelope, err := messaging.EnvelopeFromDelivery(d)
+					So(err, ShouldBeNil)
+					So(envelope.Type, ShouldEqual, "AccountChanged")
+					event := commonmodel.AccountChanged{}
+					So(json.Unmarshal(envelope.Body, &event), ShouldBeNil)
+					So(event.EventName, ShouldEqual, "UPDATED")
+					accountIDs[event.AccountID] = true
+				}
+				So(len(accountIDs), ShouldEqual, 20)
+				So(accountIDs, ShouldContainKey, "10000")
+				So(accountIDs, ShouldContainKey, "10019")
+			})
+		})
+	})
+}
+
+func TestRelayUnroutableEvents(t *testing.T) {
+	Convey("Given a stored account and a broker where nothing receives account events yet", t, func() {
+		dir, err := ioutil.TempDir("", "outbox")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		repo := &dbclient.BoltClient{Path: filepath.Join(dir, "accounts.db")}
+		repo.OpenBoltDb()
+		defer repo.CloseBoltDb()
+		DBClient = repo
+
+		broker := &messaging.InMemoryMessagingClient{}
+		broker.ConnectToBroker(messaging.InMemoryBrokerURL)
+		defer broker.Close()
+		MessagingClient = broker
+		So(repo.StoreAccount(context.Background(), model.Account{Id: "10000", Name: "Person"}, "UPDATED"), ShouldBeNil)
+
+		Convey("When the relay runs", func() {
+			sent, err := relayPendingEvents()
+
+			Convey("Then the event stays in the outbox", func() {
+				So(err, ShouldNotBeNil)
+				So(sent, ShouldEqual, 0)
+				pending, err := repo.PendingOutboxEvents(outboxBatchSize)
+				So(err, ShouldBeNil)
+				So(pending, ShouldHaveLength, 1)
+			})
+
+			Convey("Then it is published and deleted once a queue is bound", func() {
+				So(broker.DeclareTopology(messaging.Topology{
+					Exchanges: map[string]messaging.ExchangeConfig{"accountevents": {Name: "accountEvents", Type: "topic"}},
+					Queues:    map[string]messaging.QueueConfig{"accountevents": {Name: "accountEvents"}},
+					Bindings: map[string]messaging.BindingConfig{
+						"accountevents": {Queue: "accountEvents", Exchange: "accountEvents", RoutingKey: "#"},
+					},
+				}), ShouldBeNil)
+				sent, err := relayPendingEvents()
+				So(err, ShouldBeNil)
+				So(sent, ShouldEqual, 1)
+				pending, err := repo.PendingOutboxEvents(outboxBatchSize)
+				So(err, ShouldBeNil)
+				So(pending, ShouldBeEmpty)
+				So(repo.MarkOutboxEventSent(1), ShouldNotBeNil) // Deleted, not kept as sent
+			})
+		})
+	})
+}
@@ -1,8 +1,7 @@
 package service
 
 import (
-	"net/http"
-
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 
 	"github.com/gorilla/mux"
@@ -14,17 +13,9 @@ func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
 	for _, route := range routes {
-		router.Methods(route.Method).Path(route.Pattern).Name(route.Name).Handler(loadTracing(route.HandlerFunc))
+		router.Methods(route.Method).Path(route.Pattern).Name(route.Name).Handler(route.HandlerFunc)
 	}
+	router.Use(logging.RequestIDMiddleware, tracing.HTTPMiddleware)
 
 	return router
 }
-
-func loadTracing(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		span := tracing.StartHTTPTrace(req, "GetAccount") // Start the span
-		ctx := tracing.UpdateContext(req.Context(), span) // Add span to context
-		next.ServeHTTP(rw, req.WithContext(ctx))          // Note next-based chaining and copy of context!!
-		span.Finish()                                     // Finish the span
-	})
-}
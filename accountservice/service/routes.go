@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	gqlhandler "github.com/graphql-go/graphql-go-handler"
+	"github.com/linhnh123/golang-microservices-tutorial/common/config"
 )
 
 type Route struct {
@@ -22,6 +23,12 @@ var routes = Routes{
 		"/accounts/{accountId}",
 		GetAccount,
 	},
+	Route{
+		"UpdateAccount",
+		"PUT",
+		"/accounts/{accountId}",
+		UpdateAccount,
+	},
 	Route{
 		"HealthCheck",
 		"GET",
@@ -37,4 +44,16 @@ var routes = Routes{
 			Pretty: false,
 		}).ServeHTTP,
 	},
+	Route{
+		"AdminConfig",
+		"GET",
+		"/admin/config",
+		config.AdminOnly(config.ConfigHandler),
+	},
+	Route{
+		"AdminConfigRefresh",
+		"POST",
+		"/admin/config/refresh",
+		config.AdminOnly(config.RefreshHandler),
+	},
 }
@@ -2,14 +2,17 @@ package circuitbreaker
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 	"github.com/linhnh123/golang-microservices-tutorial/common/util"
 
@@ -27,11 +30,15 @@ type DiscoveryToken struct {
 }
 
 func init() {
-	log.SetOutput(ioutil.Discard)
+	messaging.RegisterMessageType("DiscoveryToken", 1, DiscoveryToken{})
 }
 
 var Client http.Client
 var RETRIES = 3
+var RetryBackoff = 100 * time.Millisecond
+
+// Guards RETRIES and RetryBackoff once they can be changed by a config refresh.
+var retryLock sync.RWMutex
 
 func CallUsingCircuitBreaker(breakerName string, url string, method string) ([]byte, error) {
 	output := make(chan []byte, 1)
@@ -58,7 +65,7 @@ func CallUsingCircuitBreaker(breakerName string, url string, method string) ([]b
 }
 
 func callWithRetriesreq(req *http.Request, output chan []byte) error {
-	r := retrier.New(retrier.ConstantBackoff(RETRIES, 100*time.Millisecond), nil)
+	r := retrier.New(retryBackoff(), nil)
 	attempt := 0
 	err := r.Run(func() error {
 		attempt++
@@ -81,15 +88,14 @@ func callWithRetriesreq(req *http.Request, output chan []byte) error {
 
 func ConfigureHystrix(commands []string, amqpClient messaging.IMessagingClient) {
 	for _, command := range commands {
-		hystrix.ConfigureCommand(command, hystrix.CommandConfig{
-			Timeout:                resolveProperty(command, "Timeout"),
-			MaxConcurrentRequests:  resolveProperty(command, "MaxConcurrentRequests"),
-			ErrorPercentThreshold:  resolveProperty(command, "ErrorPercentThreshold"),
-			RequestVolumeThreshold: resolveProperty(command, "RequestVolumeThreshold"),
-			SleepWindow:            resolveProperty(command, "SleepWindow"),
-		})
-		logrus.Printf("Circuit %v settings: %v", command, hystrix.GetCircuitSettings()[command])
+		configureCommand(command)
 	}
+	configureRetries()
+
+	// Pick up changes from the config server without a restart
+	config.WatchKeys("hystrix.command.", func(keys []string) { reconfigureCommands(commands, keys) })
+	config.WatchInt("http_retries", func(oldValue int, newValue int) { configureRetries() })
+	config.WatchInt("http_retry_backoff_ms", func(oldValue int, newValue int) { configureRetries() })
 
 	hystrixStreamHandler := hystrix.NewStreamHandler()
 	hystrixStreamHandler.Start()
@@ -100,6 +106,67 @@ func ConfigureHystrix(commands []string, amqpClient messaging.IMessagingClient)
 	publishDiscoveryToken(amqpClient)
 }
 
+func configureCommand(command string) {
+	hystrix.ConfigureCommand(command, hystrix.CommandConfig{
+		Timeout:                resolveProperty(command, "Timeout"),
+		MaxConcurrentRequests:  resolveProperty(command, "MaxConcurrentRequests"),
+		ErrorPercentThreshold:  resolveProperty(command, "ErrorPercentThreshold"),
+		RequestVolumeThreshold: resolveProperty(command, "RequestVolumeThreshold"),
+		SleepWindow:            resolveProperty(command, "SleepWindow"),
+	})
+	logrus.Printf("Circuit %v settings: %v", command, hystrix.GetCircuitSettings()[command])
+}
+
+// reconfigureCommands configures each of commands with a changed key once. Hystrix sizes a
+// circuit's pool of MaxConcurrentRequests tickets only when creating it, and can only drop all
+// circuits at once, resetting their state and metrics too. So a changed MaxConcurrentRequests only
+// flushes the circuits if hystrix_flush_on_pool_change is set, and otherwise applies on restart.
+func reconfigureCommands(commands []string, keys []string) {
+	resized := make([]string, 0)
+	for _, command := range commands {
+		prefix := "hystrix.command." + strings.ToLower(command) + "."
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				logrus.Infof("%v changed, reconfiguring circuit %v", key, command)
+				before := hystrix.GetCircuitSettings()[command]
+				configureCommand(command)
+				if before == nil || before.MaxConcurrentRequests != hystrix.GetCircuitSettings()[command].MaxConcurrentRequests {
+					resized = append(resized, command)
+				}
+				break
+			}
+		}
+	}
+	if len(resized) == 0 {
+		return
+	}
+	if !viper.GetBool("hystrix_flush_on_pool_change") {
+		logrus.Warnf("MaxConcurrentRequests of circuits %v changed, it applies after a restart, or set hystrix_flush_on_pool_change to flush all circuits", resized)
+		return
+	}
+	logrus.Warnf("MaxConcurrentRequests of circuits %v changed, flushing all circuits", resized)
+	hystrix.Flush()
+}
+
+// configureRetries applies http_retries and http_retry_backoff_ms, if set.
+func configureRetries() {
+	retryLock.Lock()
+	defer retryLock.Unlock()
+	if viper.IsSet("http_retries") {
+		RETRIES = viper.GetInt("http_retries")
+	}
+	if viper.IsSet("http_retry_backoff_ms") {
+		RetryBackoff = time.Duration(viper.GetInt("http_retry_backoff_ms")) * time.Millisecond
+	}
+	logrus.Printf("Retrying failed calls %v times, %v apart", RETRIES, RetryBackoff)
+}
+
+func retryBackoff() []time.Duration {
+	retryLock.RLock()
+	defer retryLock.RUnlock()
+	return retrier.ConstantBackoff(RETRIES, RetryBackoff)
+}
+
 func resolveProperty(command string, prop string) int {
 	if viper.IsSet("hystrix.command." + command + "." + prop) {
 		return viper.GetInt("hystrix.command." + command + "." + prop)
@@ -117,11 +184,10 @@ func publishDiscoveryToken(amqpClient messaging.IMessagingClient) {
 		State:   "UP",
 		Address: ip,
 	}
-	bytes, _ := json.Marshal(token)
 	go func() {
 		for {
-			amqpClient.PublishOnQueue(bytes, "discovery")
-			amqpClient.PublishOnQueue(bytes, "discovery")
+			messaging.PublishTypedOnQueue(context.Background(), amqpClient, token, "discovery")
+			messaging.PublishTypedOnQueue(context.Background(), amqpClient, token, "discovery")
 			time.Sleep(time.Second * 30)
 		}
 	}()
@@ -152,35 +218,35 @@ func Deregister(amqpClient messaging.IMessagingClient) {
 		State:   "DOWN",
 		Address: ip,
 	}
-	bytes, _ := json.Marshal(token)
-	amqpClient.PublishOnQueue(bytes, "discovery")
+	messaging.PublishTypedOnQueue(context.Background(), amqpClient, token, "discovery")
 }
 
 func PerformHTTPRequestCircuitBreaker(ctx context.Context, breakerName string, req *http.Request) ([]byte, error) {
 	output := make(chan []byte, 1)
 	errors := hystrix.Go(breakerName, func() error {
 		tracing.AddTracingToReqFromContext(ctx, req)
+		logging.AddRequestIDToReq(ctx, req)
 		err := callWithRetries(req, output)
 		return err // For hystrix, forward the err from the retrier. It's nil if OK.
 	}, func(err error) error {
-		logrus.Errorf("In fallback function for breaker %v, error: %v", breakerName, err.Error())
+		logging.FromContext(ctx).Errorf("In fallback function for breaker %v, error: %v", breakerName, err.Error())
 		return err
 	})
 
 	select {
 	case out := <-output:
-		logrus.Debugf("Call in breaker %v successful", breakerName)
+		logging.FromContext(ctx).Debugf("Call in breaker %v successful", breakerName)
 		return out, nil
 
 	case err := <-errors:
-		logrus.Errorf("Got error on channel in breaker %v. Msg: %v", breakerName, err.Error())
+		logging.FromContext(ctx).Errorf("Got error on channel in breaker %v. Msg: %v", breakerName, err.Error())
 		return nil, err
 	}
 }
 
 func callWithRetries(req *http.Request, output chan []byte) error {
 
-	r := retrier.New(retrier.ConstantBackoff(RETRIES, 100*time.Millisecond), nil)
+	r := retrier.New(retryBackoff(), nil)
 	attempt := 0
 	err := r.Run(func() error {
 		attempt++
@@ -2,9 +2,11 @@ package circuitbreaker
 
 import (
 	"testing"
+	"time"
 
 	"github.com/afex/hystrix-go/hystrix"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/h2non/gock.v1"
@@ -86,6 +88,73 @@ func TestCallHystrixOpensAfterThresholdPassed(t *testing.T) {
 	})
 }
 
+func TestReconfigureCommands(t *testing.T) {
+	Convey("Given a circuit allowing one concurrent request", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		viper.Set("hystrix.command.RECONF.MaxConcurrentRequests", 1)
+		configureCommand("RECONF")
+		before, _, _ := hystrix.GetCircuit("RECONF")
+
+		Convey("When a refresh only changes the timeout", func() {
+			viper.Set("hystrix_flush_on_pool_change", true)
+			viper.Set("hystrix.command.RECONF.Timeout", 5000)
+			reconfigureCommands([]string{"RECONF"}, []string{"hystrix.command.reconf.timeout"})
+
+			Convey("Then the circuit is kept", func() {
+				after, _, _ := hystrix.GetCircuit("RECONF")
+				So(after, ShouldEqual, before)
+				So(hystrix.GetCircuitSettings()["RECONF"].Timeout, ShouldEqual, 5000*time.Millisecond)
+			})
+		})
+
+		Convey("When a refresh raises MaxConcurrentRequests without hystrix_flush_on_pool_change", func() {
+			viper.Set("hystrix.command.RECONF.MaxConcurrentRequests", 3)
+			reconfigureCommands([]string{"RECONF"}, []string{"hystrix.command.reconf.maxconcurrentrequests"})
+
+			Convey("Then the circuit is kept until a restart", func() {
+				after, _, _ := hystrix.GetCircuit("RECONF")
+				So(after, ShouldEqual, before)
+				So(hystrix.GetCircuitSettings()["RECONF"].MaxConcurrentRequests, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When a refresh raises MaxConcurrentRequests to 3 with hystrix_flush_on_pool_change", func() {
+			viper.Set("hystrix_flush_on_pool_change", true)
+			viper.Set("hystrix.command.RECONF.MaxConcurrentRequests", 3)
+			viper.Set("hystrix.command.RECONF.Timeout", 5000)
+			reconfigureCommands([]string{"OTHER", "RECONF"}, []string{
+				"hystrix.command.reconf.maxconcurrentrequests",
+				"hystrix.command.reconf.timeout",
+			})
+
+			Convey("Then the circuit is rebuilt and lets 3 requests run at once", func() {
+				after, _, _ := hystrix.GetCircuit("RECONF")
+				So(after, ShouldNotEqual, before)
+				So(hystrix.GetCircuitSettings()["RECONF"].MaxConcurrentRequests, ShouldEqual, 3)
+
+				release := make(chan struct{})
+				var errs []chan error
+				for a := 0; a < 3; a++ {
+					errs = append(errs, hystrix.Go("RECONF", func() error {
+						<-release
+						return nil
+					}, nil))
+				}
+				time.Sleep(50 * time.Millisecond)
+				close(release)
+				for _, e := range errs {
+					select {
+					case err := <-e:
+						So(err, ShouldBeNil)
+					case <-time.After(100 * time.Millisecond):
+					}
+				}
+			})
+		})
+	})
+}
+
 func buildGockMatcherTimes(status int, times int) {
 	for a := 0; a < times; a++ {
 		buildGockMatcher(status)
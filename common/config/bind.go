@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Bind fills the fields of the struct target points to from Viper, and validates them. Fields are
+// described with tags:
+//
+//	ServerPort    int    `config:"server_port" default:"6767" validate:"port"`
+//	AmqpServerUrl string `config:"amqp_server_url" validate:"required,url"`
+//
+// The validators are required, port, url, min=N, max=N and oneof=a|b|c. Supported field types are
+// string, bool, int, float64, time.Duration and []string. All problems are returned together as
+// ValidationErrors; target is only changed if there are none.
+//
+// Keys that no layer sets are taken from the environment if it has them, see Load. Target is only
+// filled in once. Whenever Load or Reload changes the configuration, a copy of it is bound again and
+// becomes what the returned Binding gets. If the new configuration is invalid, the problems are
+// logged and the Binding keeps the previous one.
+func Bind(target interface{}) (*Binding, error) {
+	if err := declare(configKeys(target)); err != nil {
+		return nil, err
+	}
+	if err := bind(target); err != nil {
+		return nil, err
+	}
+	binding := &Binding{}
+	binding.current.Store(copyStruct(target))
+	boundLock.Lock()
+	bound = append(bound, binding)
+	boundLock.Unlock()
+	return binding, nil
+}
+
+// Binding holds the latest valid configuration bound to a struct. Refreshes bind a copy and swap
+// it in, so the struct Get returns is never written to and can be read from any goroutine.
+type Binding struct {
+	current atomic.Value
+}
+
+// Get returns a pointer to the current configuration, of the same type as the target passed to
+// Bind. It must not be changed.
+func (b *Binding) Get() interface{} {
+	return b.current.Load()
+}
+
+// ValidationError is a problem with the value of a single key.
+type ValidationError struct {
+	Key     string
+	Problem string
+}
+
+func (e ValidationError) Error() string {
+	return e.Key + ": " + e.Problem
+}
+
+// ValidationErrors lists every problem found in a configuration.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration problem(s):\n  %s", len(e), strings.Join(problems, "\n  "))
+}
+
+var (
+	boundLock sync.Mutex
+	bound     []*Binding
+)
+
+// rebind binds a copy of the current configuration of every Binding and swaps it in.
+func rebind() {
+	boundLock.Lock()
+	defer boundLock.Unlock()
+	for _, binding := range bound {
+		target := copyStruct(binding.Get())
+		if err := bind(target); err != nil {
+			log.Printf("Ignoring refreshed configuration for %T, %v\n", target, err)
+			continue
+		}
+		binding.current.Store(target)
+	}
+}
+
+// copyStruct returns a pointer to a shallow copy of the struct target points to.
+func copyStruct(target interface{}) interface{} {
+	ptr := reflect.ValueOf(target)
+	copied := reflect.New(ptr.Elem().Type())
+	copied.Elem().Set(ptr.Elem())
+	return copied.Interface()
+}
+
+// configKeys returns the keys in the config tags of the struct target points to.
+func configKeys(target interface{}) []string {
+	t := reflect.TypeOf(target)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	keys := make([]string, 0, t.Elem().NumField())
+	for i := 0; i < t.Elem().NumField(); i++ {
+		if key := t.Elem().Field(i).Tag.Get("config"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func bind(target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Can only bind configuration to a pointer to a struct, not %T", target)
+	}
+	result := reflect.New(ptr.Elem().Type()).Elem()
+	result.Set(ptr.Elem())
+	structType := result.Type()
+
+	problems := ValidationErrors{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key := field.Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		validators := strings.Split(field.Tag.Get("validate"), ",")
+
+		var raw interface{}
+		if viper.IsSet(key) {
+			raw = viper.Get(key)
+		} else if value, ok := field.Tag.Lookup("default"); ok {
+			raw = value
+		}
+		if raw == nil || raw == "" {
+			if contains(validators, "required") {
+				problems = append(problems, ValidationError{key, "is required"})
+			}
+			result.Field(i).Set(reflect.Zero(field.Type))
+			continue
+		}
+
+		value, err := convert(raw, field.Type)
+		if err != nil {
+			problems = append(problems, validationError(key, err))
+			continue
+		}
+		for _, validator := range validators {
+			if err := validate(validator, value); err != nil {
+				problems = append(problems, validationError(key, err))
+			}
+		}
+		result.Field(i).Set(reflect.ValueOf(value).Convert(field.Type))
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	ptr.Elem().Set(result)
+	return nil
+}
+
+// validationError describes a problem, without showing the value if it is a secret.
+func validationError(key string, err error) ValidationError {
+	if IsSecret(key) {
+		return ValidationError{key, "has an invalid value, not shown since it is a secret"}
+	}
+	return ValidationError{key, err.Error()}
+}
+
+func convert(raw interface{}, to reflect.Type) (interface{}, error) {
+	var value interface{}
+	var err error
+	switch {
+	case to == reflect.TypeOf(time.Duration(0)):
+		value, err = cast.ToDurationE(raw)
+	case to.Kind() == reflect.String:
+		value, err = cast.ToStringE(raw)
+	case to.Kind() == reflect.Bool:
+		value, err = cast.ToBoolE(raw)
+	case to.Kind() == reflect.Int:
+		value, err = cast.ToIntE(raw)
+	case to.Kind() == reflect.Float64:
+		value, err = cast.ToFloat64E(raw)
+	case to == reflect.TypeOf([]string{}):
+		if s, ok := raw.(string); ok {
+			raw = strings.Split(s, ",")
+		}
+		value, err = cast.ToStringSliceE(raw)
+	default:
+		return nil, fmt.Errorf("has unsupported type %v", to)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("'%v' is not a valid %v", raw, to)
+	}
+	return value, nil
+}
+
+func validate(validator string, value interface{}) error {
+	name, arg := validator, ""
+	if i := strings.Index(validator, "="); i >= 0 {
+		name, arg = validator[:i], validator[i+1:]
+	}
+	switch name {
+	case "", "required":
+		return nil
+	case "port":
+		if port := cast.ToInt(value); port < 1 || port > 65535 {
+			return fmt.Errorf("%v is not a valid port", value)
+		}
+	case "url":
+		u, err := url.Parse(cast.ToString(value))
+		if err != nil || u.Scheme == "" {
+			return fmt.Errorf("'%v' is not a valid URL", value)
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Errorf("has a bad %v validator", name)
+		}
+		n := cast.ToFloat64(value)
+		if s, ok := value.(string); ok {
+			n = float64(len(s))
+		}
+		if name == "min" && n < limit {
+			return fmt.Errorf("%v is less than %v", value, arg)
+		}
+		if name == "max" && n > limit {
+			return fmt.Errorf("%v is more than %v", value, arg)
+		}
+	case "oneof":
+		if !contains(strings.Split(arg, "|"), cast.ToString(value)) {
+			return fmt.Errorf("'%v' is not one of %v", value, strings.Replace(arg, "|", ", ", -1))
+		}
+	default:
+		return fmt.Errorf("has unknown validator %v", name)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
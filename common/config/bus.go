@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/spf13/viper"
+)
+
+const (
+	refreshEventType = "RefreshRemoteApplicationEvent"
+	ackEventType     = "AckRemoteApplicationEvent"
+	refreshEventName = "org.springframework.cloud.bus.event.RefreshRemoteApplicationEvent"
+)
+
+// InstanceID tells instances of the same service apart in bus IDs. Defaults to the host name,
+// which is the container ID when running in Docker.
+var InstanceID = hostname()
+
+// AckRemoteApplicationEvent is sent on the bus by an instance once it has handled a refresh.
+type AckRemoteApplicationEvent struct {
+	Type                  string `json:"type"`
+	Timestamp             int64  `json:"timestamp"`
+	OriginService         string `json:"originService"`
+	DestinationService    string `json:"destinationService"`
+	Id                    string `json:"id"`
+	AckId                 string `json:"ackId"`
+	AckDestinationService string `json:"ackDestinationService"`
+	Event                 string `json:"event"`
+}
+
+// BusID identifies this instance on the Spring Cloud Bus, as appName:port:instance, e.g.
+// accountservice:6767:3f2a9c1b7d4e.
+func BusID(appName string) string {
+	return appName + ":" + viper.GetString("server_port") + ":" + InstanceID
+}
+
+// MatchesDestination reports whether a bus event for destination is meant for busID. Like Spring
+// Cloud Bus, destinations are ant-style patterns with ':' as separator, so "accountservice:**"
+// matches every accountservice instance. A destination with at most one ':' is short for
+// "destination:**", so "accountservice" and "accountservice:6767" match all instances of the
+// service, or of the service on that port. An empty destination matches everybody.
+func MatchesDestination(destination string, busID string) bool {
+	if destination == "" || destination == "**" {
+		return true
+	}
+	if strings.Count(destination, ":") <= 1 && !strings.HasSuffix(destination, ":**") {
+		destination += ":**"
+	}
+	return matchSegments(strings.Split(destination, ":"), strings.Split(busID, ":"))
+}
+
+// matchSegments matches segment by segment, where "**" matches any number of segments.
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(segments) > 0 && matchSegment(pattern[0], segments[0]) && matchSegments(pattern[1:], segments[1:])
+}
+
+// matchSegment matches a single segment, where '*' matches any number of characters and '?'
+// exactly one.
+func matchSegment(pattern string, segment string) bool {
+	if pattern == "" {
+		return segment == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(segment); i++ {
+			if matchSegment(pattern[1:], segment[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return segment != "" && matchSegment(pattern[1:], segment[1:])
+	default:
+		return segment != "" && pattern[0] == segment[0] && matchSegment(pattern[1:], segment[1:])
+	}
+}
+
+// publishAck tells the bus that the refresh event has been handled by busID.
+func publishAck(client messaging.IMessagingClient, exchangeName string, busID string, event UpdateToken) error {
+	ack := AckRemoteApplicationEvent{
+		Type:                  ackEventType,
+		Timestamp:             time.Now().UnixNano() / int64(time.Millisecond),
+		OriginService:         busID,
+		DestinationService:    "**",
+		Id:                    messaging.NewMessageID(),
+		AckId:                 event.Id,
+		AckDestinationService: event.DestinationService,
+		Event:                 refreshEventName,
+	}
+	body, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return client.Publish(body, exchangeName, "topic")
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return messaging.NewMessageID()
+	}
+	return name
+}
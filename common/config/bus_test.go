@@ -0,0 +1,107 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func receiveAck(acks chan amqp.Delivery) *amqp.Delivery {
+	select {
+	case d := <-acks:
+		return &d
+	case <-time.After(time.Millisecond * 500):
+		return nil
+	}
+}
+
+func TestMatchesDestination(t *testing.T) {
+	Convey("Given the bus ID of an accountservice instance", t, func() {
+		busID := "accountservice:6767:3f2a9c1b7d4e"
+
+		Convey("Then destinations for every service match", func() {
+			So(MatchesDestination("", busID), ShouldBeTrue)
+			So(MatchesDestination("**", busID), ShouldBeTrue)
+		})
+
+		Convey("Then destinations for the service match", func() {
+			So(MatchesDestination("accountservice", busID), ShouldBeTrue)
+			So(MatchesDestination("accountservice:**", busID), ShouldBeTrue)
+			So(MatchesDestination("account*:**", busID), ShouldBeTrue)
+		})
+
+		Convey("Then destinations for the instance match", func() {
+			So(MatchesDestination("accountservice:6767:3f2a9c1b7d4e", busID), ShouldBeTrue)
+			So(MatchesDestination("accountservice:*:3f2a9c1b7d4e", busID), ShouldBeTrue)
+			So(MatchesDestination("accountservice:676?:**", busID), ShouldBeTrue)
+		})
+
+		Convey("Then destinations for the service on its port match", func() {
+			So(MatchesDestination("accountservice:6767", busID), ShouldBeTrue)
+			So(MatchesDestination("accountservice:*", busID), ShouldBeTrue)
+		})
+
+		Convey("Then destinations for other services and instances don't match", func() {
+			So(MatchesDestination("xxxaccountservice2:**", busID), ShouldBeFalse)
+			So(MatchesDestination("accountservice2:**", busID), ShouldBeFalse)
+			So(MatchesDestination("account", busID), ShouldBeFalse)
+			So(MatchesDestination("accountservice:6767:other", busID), ShouldBeFalse)
+			So(MatchesDestination("accountservice:8080", busID), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRefreshEventHandler(t *testing.T) {
+	Convey("Given an instance listening for refresh events on the bus", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		So(Load(Options{Offline: true, Defaults: map[string]interface{}{"server_port": 6767}}), ShouldBeNil)
+		InstanceID = "instance1"
+
+		bus := &messaging.InMemoryMessagingClient{}
+		defer bus.Close()
+		acks := make(chan amqp.Delivery, 10)
+		bus.Subscribe("springCloudBus", "topic", "observer", func(d amqp.Delivery) {
+			if event := (AckRemoteApplicationEvent{}); json.Unmarshal(d.Body, &event) == nil && event.Type == ackEventType {
+				acks <- d
+			}
+		})
+		handler := RefreshEventHandler(bus, "springCloudBus")
+		refresh := func(destination string) {
+			handler(amqp.Delivery{
+				ConsumerTag: "accountservice",
+				Body: []byte(`{"type":"RefreshRemoteApplicationEvent","timestamp":1494514362123,"originService":"config-server:docker:8888",` +
+					`"destinationService":"` + destination + `","id":"53e61c71-cbae-4b6d-84bb-d0dcc0aeb4dc"}`),
+			})
+		}
+
+		Convey("When a refresh for the service arrives", func() {
+			refresh("accountservice:**")
+
+			Convey("Then an ack for it is published", func() {
+				d := receiveAck(acks)
+				So(d, ShouldNotBeNil)
+				event := AckRemoteApplicationEvent{}
+				So(json.Unmarshal(d.Body, &event), ShouldBeNil)
+				So(event.AckId, ShouldEqual, "53e61c71-cbae-4b6d-84bb-d0dcc0aeb4dc")
+				So(event.AckDestinationService, ShouldEqual, "accountservice:**")
+				So(event.OriginService, ShouldEqual, "accountservice:6767:instance1")
+				So(event.Event, ShouldEqual, refreshEventName)
+			})
+		})
+
+		Convey("When a refresh for another service arrives", func() {
+			refresh("xxxaccountservice2:**")
+
+			Convey("Then nothing is acknowledged", func() {
+				So(receiveAck(acks), ShouldBeNil)
+			})
+		})
+	})
+}
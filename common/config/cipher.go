@@ -0,0 +1,316 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+)
+
+const cipherPrefix = "{cipher}"
+
+// The salt Spring Cloud Config uses unless told otherwise, in hex.
+const defaultSalt = "deadbeef"
+
+// How decrypted values are shown in logs.
+const maskedValue = "******"
+
+// Decrypter decrypts values encrypted by the Spring Cloud Config server's /encrypt endpoint.
+type Decrypter interface {
+	Decrypt(cipherText string) (string, error)
+}
+
+// The RSA algorithms the config server can encrypt the secret with, set as encrypt.rsa.algorithm.
+const (
+	// RSAAlgorithmDefault is PKCS#1 v1.5, which the config server uses unless told otherwise.
+	RSAAlgorithmDefault = "DEFAULT"
+	// RSAAlgorithmOAEP is RSA OAEP with SHA-1.
+	RSAAlgorithmOAEP = "OAEP"
+)
+
+// NewDecrypterFromEnv returns a decrypter for the key in the environment. ENCRYPT_KEY holds a
+// symmetric key, ENCRYPT_KEY_FILE the path to a PEM encoded RSA private key, and
+// ENCRYPT_RSA_ALGORITHM the RSA algorithm if the config server doesn't use RSAAlgorithmDefault.
+//
+// Like the config server's encrypt.keyStore.* properties, ENCRYPT_KEY_STORE_LOCATION,
+// ENCRYPT_KEY_STORE_PASSWORD and ENCRYPT_KEY_STORE_ALIAS select an RSA key in a keystore instead,
+// see NewRSADecrypterFromKeyStore. Returns nil if no key is set.
+func NewDecrypterFromEnv() (Decrypter, error) {
+	if key := os.Getenv("ENCRYPT_KEY"); key != "" {
+		return NewSymmetricDecrypter(key), nil
+	}
+	if file := os.Getenv("ENCRYPT_KEY_FILE"); file != "" {
+		return NewRSADecrypterFromFile(file, os.Getenv("ENCRYPT_RSA_ALGORITHM"))
+	}
+	if location := os.Getenv("ENCRYPT_KEY_STORE_LOCATION"); location != "" {
+		if secret := os.Getenv("ENCRYPT_KEY_STORE_SECRET"); secret != "" && secret != os.Getenv("ENCRYPT_KEY_STORE_PASSWORD") {
+			return nil, fmt.Errorf("Keys with their own password (ENCRYPT_KEY_STORE_SECRET) are not supported, the key must be protected by the keystore password")
+		}
+		return NewRSADecrypterFromKeyStore(location, os.Getenv("ENCRYPT_KEY_STORE_PASSWORD"),
+			os.Getenv("ENCRYPT_KEY_STORE_ALIAS"), os.Getenv("ENCRYPT_RSA_ALGORITHM"))
+	}
+	return nil, nil
+}
+
+// NewSymmetricDecrypter returns a decrypter for values encrypted with the symmetric key set as
+// encrypt.key on the config server.
+func NewSymmetricDecrypter(key string) Decrypter {
+	return &symmetricDecrypter{key: key}
+}
+
+type symmetricDecrypter struct {
+	key string
+}
+
+// Decrypt handles hex encoded AES/CBC output, IV first, like Spring Security's Encryptors.text.
+func (s *symmetricDecrypter) Decrypt(cipherText string) (string, error) {
+	data, err := hex.DecodeString(cipherText)
+	if err != nil {
+		return "", fmt.Errorf("Encrypted value is not hex encoded: %v", err)
+	}
+	plain, err := decryptCBC(s.key, data)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// NewRSADecrypterFromFile returns a decrypter for the PEM encoded RSA private key in file, for
+// secrets encrypted with algorithm, RSAAlgorithmDefault if empty.
+func NewRSADecrypterFromFile(file string, algorithm string) (Decrypter, error) {
+	oaep, err := isOAEP(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %v", file)
+	}
+	key, err := parseRSAKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse private key in %v: %v", file, err)
+	}
+	return &rsaDecrypter{key: key, oaep: oaep}, nil
+}
+
+// NewRSADecrypterFromKeyStore returns a decrypter for the RSA private key stored as alias in the
+// PKCS#12 keystore at location, for secrets encrypted with algorithm, RSAAlgorithmDefault if
+// empty. The alias can be left empty if the keystore holds a single key.
+//
+// JKS keystores, the config server's default, are not supported. Convert one with:
+//
+//	keytool -importkeystore -srckeystore server.jks -destkeystore server.p12 -deststoretype pkcs12
+//
+// Only PKCS#12 files encrypted with 3DES or RC2 can be read. Java 12 and later, and OpenSSL 3,
+// encrypt with AES by default; re-export those with:
+//
+//	openssl pkcs12 -in server.p12 -nodes -out key.pem
+//	openssl pkcs12 -export -legacy -in key.pem -name <alias> -out legacy.p12
+func NewRSADecrypterFromKeyStore(location string, password string, alias string, algorithm string) (Decrypter, error) {
+	oaep, err := isOAEP(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read keystore: %v", err)
+	}
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == jksMagic {
+		return nil, fmt.Errorf("%v is a JKS keystore, which is not supported, convert it to PKCS#12 with keytool -importkeystore", location)
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read keystore %v: %v", location, err)
+	}
+	aliases := make([]string, 0)
+	for _, block := range blocks {
+		if block.Type != "PRIVATE KEY" {
+			continue
+		}
+		name := block.Headers["friendlyName"]
+		aliases = append(aliases, name)
+		if alias != "" && !strings.EqualFold(name, alias) {
+			continue
+		}
+		key, err := parseRSAKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse private key %v in %v: %v", name, location, err)
+		}
+		return &rsaDecrypter{key: key, oaep: oaep}, nil
+	}
+	return nil, fmt.Errorf("No private key with alias '%v' in %v, found %v", alias, location, aliases)
+}
+
+// The first four bytes of a JKS keystore.
+const jksMagic = 0xfeedfeed
+
+// isOAEP returns whether algorithm is RSAAlgorithmOAEP, or an error if it is neither that nor
+// RSAAlgorithmDefault.
+func isOAEP(algorithm string) (bool, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", RSAAlgorithmDefault:
+		return false, nil
+	case RSAAlgorithmOAEP:
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unknown RSA algorithm '%v', use %v or %v", algorithm, RSAAlgorithmDefault, RSAAlgorithmOAEP)
+	}
+}
+
+// parseRSAKey parses a PKCS#1 or PKCS#8 DER encoded RSA private key.
+func parseRSAKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Not an RSA key")
+	}
+	return key, nil
+}
+
+type rsaDecrypter struct {
+	key  *rsa.PrivateKey
+	oaep bool
+}
+
+// Decrypt handles the format of Spring Security's RsaSecretEncryptor: base64 of a two byte length,
+// a random secret encrypted with RSA, and the value encrypted with AES using that secret.
+func (r *rsaDecrypter) Decrypt(cipherText string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil {
+		return "", fmt.Errorf("Encrypted value is not base64 encoded: %v", err)
+	}
+	if len(data) < 2 {
+		return "", fmt.Errorf("Encrypted value is too short")
+	}
+	length := int(data[0])<<8 | int(data[1])
+	if len(data) < 2+length {
+		return "", fmt.Errorf("Encrypted value is too short")
+	}
+	var secret []byte
+	if r.oaep {
+		secret, err = rsa.DecryptOAEP(sha1.New(), nil, r.key, data[2:2+length], nil)
+	} else {
+		secret, err = rsa.DecryptPKCS1v15(nil, r.key, data[2:2+length])
+	}
+	if err != nil {
+		return "", fmt.Errorf("Couldn't decrypt secret: %v", err)
+	}
+	password := hex.EncodeToString(secret)
+	data = data[2+length:]
+
+	// Newer servers use GCM, older ones CBC.
+	plain, err := decryptGCM(password, data)
+	if err != nil {
+		if plain, err = decryptCBC(password, data); err != nil {
+			return "", err
+		}
+	}
+	return string(plain), nil
+}
+
+func deriveKey(password string) []byte {
+	salt, _ := hex.DecodeString(defaultSalt)
+	return pbkdf2.Key([]byte(password), salt, 1024, 32, sha1.New)
+}
+
+func decryptCBC(password string, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(deriveKey(password))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Encrypted value has the wrong length")
+	}
+	iv, data := data[:aes.BlockSize], data[aes.BlockSize:]
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// PKCS#5 padding; a wrong key mostly shows up as bad padding.
+	padding := int(plain[len(plain)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("Couldn't decrypt value, wrong key?")
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("Couldn't decrypt value, wrong key?")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+func decryptGCM(password string, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(deriveKey(password))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, 16)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 16+gcm.Overhead() {
+		return nil, fmt.Errorf("Encrypted value has the wrong length")
+	}
+	return gcm.Open(nil, data[:16], data[16:], nil)
+}
+
+// decryptValues replaces {cipher} values with their plain text. Keys that can't be decrypted are
+// removed rather than set to the encrypted text. Returns the keys that hold secrets.
+func decryptValues(values map[string]interface{}, decrypter Decrypter) map[string]bool {
+	secrets := make(map[string]bool)
+	for key, value := range values {
+		text, ok := value.(string)
+		if !ok || !strings.HasPrefix(text, cipherPrefix) {
+			continue
+		}
+		secrets[key] = true
+		if decrypter == nil {
+			logCipherError(key, fmt.Errorf("No key to decrypt it with, set ENCRYPT_KEY or ENCRYPT_KEY_FILE"))
+			delete(values, key)
+			continue
+		}
+		plain, err := decrypter.Decrypt(stripCipherOptions(strings.TrimPrefix(text, cipherPrefix)))
+		if err != nil {
+			logCipherError(key, err)
+			delete(values, key)
+			continue
+		}
+		values[key] = plain
+	}
+	return secrets
+}
+
+func logCipherError(key string, err error) {
+	log.Printf("Couldn't decrypt config property %v, leaving it unset: %v\n", key, err)
+}
+
+// stripCipherOptions drops the {key:...} and {secret:...} prefixes the config server allows
+// in front of the cipher text. Only the default key is supported.
+func stripCipherOptions(text string) string {
+	for strings.HasPrefix(text, "{") && strings.Contains(text, "}") {
+		text = text[strings.Index(text, "}")+1:]
+	}
+	return text
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Encrypted with the key "foo", the way the config server does with encrypt.key set.
+const symmetricCipherText = "00112233445566778899aabbccddeeff211948882deb6d4751488bf662a3807c"
+
+// "guest", encrypted for testdata/cipher-key.pem the way the config server's RsaSecretEncryptor
+// does with its default settings. It was made with openssl rather than the Go code under test:
+//
+//	secret: 16 random bytes, password: hex of secret
+//	openssl pkeyutl -encrypt -inkey cipher-key.pem -pkeyopt rsa_padding_mode:pkcs1 -in secret
+//	openssl kdf -keylen 32 -kdfopt digest:SHA1 -kdfopt pass:$password -kdfopt hexsalt:deadbeef -kdfopt iter:1024 PBKDF2
+//	openssl enc -aes-256-cbc -K $key -iv $iv
+//	base64 of: two byte length, encrypted secret, iv, encrypted value
+//
+// To check against a real config server, start it with this key in its key store and replace the
+// value with the output of: curl -X POST --data-binary guest http://configserver:8888/encrypt
+const rsaCipherText = "AIAMoI8EiiA/cOZuqnCtXWvj0DHvkq+q8ycunLoxxJ8O3nqLYKLI3Gpyx1LeEILAm64Qa4R67xl/VDeZjK2R7kF5VyVTvpDoJPV9AqGhPYoSNpAGQ4yg/mpMq8xE7QZA1RN4DmiEdxhY+4xHWs6dhwlfLMcP79dTxAaQP35E1eV4rYPuWctneQQClgg5QqzYaFXOGRJ5mvnYArcm+21INiCC"
+
+// encryptRSAGCM encrypts like a config server set up with encrypt.rsa.algorithm OAEP and
+// encrypt.rsa.strong, which uses AES/GCM for the value.
+func encryptRSAGCM(key *rsa.PrivateKey, plain string) string {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	encryptedSecret, _ := rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, secret, nil)
+	block, _ := aes.NewCipher(deriveKey(hex.EncodeToString(secret)))
+	gcm, _ := cipher.NewGCMWithNonceSize(block, 16)
+	iv := make([]byte, 16)
+	rand.Read(iv)
+
+	data := []byte{byte(len(encryptedSecret) >> 8), byte(len(encryptedSecret))}
+	data = append(data, encryptedSecret...)
+	data = append(data, iv...)
+	data = gcm.Seal(data, iv, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestDecrypt(t *testing.T) {
+	Convey("Given a symmetric key", t, func() {
+		decrypter := NewSymmetricDecrypter("foo")
+
+		Convey("Then values encrypted with it are decrypted", func() {
+			plain, err := decrypter.Decrypt(symmetricCipherText)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "mysecret")
+		})
+
+		Convey("Then values encrypted with another key are rejected", func() {
+			_, err := NewSymmetricDecrypter("bar").Decrypt(symmetricCipherText)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an RSA private key and the config server's default algorithm", t, func() {
+		decrypter, err := NewRSADecrypterFromFile("testdata/cipher-key.pem", "")
+		So(err, ShouldBeNil)
+
+		Convey("Then values encrypted with PKCS#1 v1.5 and AES/CBC are decrypted", func() {
+			plain, err := decrypter.Decrypt(rsaCipherText)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "guest")
+		})
+
+		Convey("Then values encrypted with OAEP are rejected", func() {
+			_, err := decrypter.Decrypt(encryptRSAGCM(decrypter.(*rsaDecrypter).key, "s3cr3t"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an RSA private key and the OAEP algorithm", t, func() {
+		decrypter, err := NewRSADecrypterFromFile("testdata/cipher-key.pem", RSAAlgorithmOAEP)
+		So(err, ShouldBeNil)
+
+		Convey("Then values encrypted with OAEP and AES/GCM are decrypted", func() {
+			plain, err := decrypter.Decrypt(encryptRSAGCM(decrypter.(*rsaDecrypter).key, "s3cr3t"))
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "s3cr3t")
+		})
+	})
+
+	Convey("Given a PKCS#12 keystore holding the RSA private key", t, func() {
+		// Made with: openssl pkcs12 -export -legacy -inkey cipher-key.pem -in cert.pem -name mytestkey -passout pass:letmein
+		const keyStore = "testdata/cipher-keystore.p12"
+
+		Convey("Then values encrypted for the key with its alias are decrypted", func() {
+			decrypter, err := NewRSADecrypterFromKeyStore(keyStore, "letmein", "mytestkey", "")
+			So(err, ShouldBeNil)
+			plain, err := decrypter.Decrypt(rsaCipherText)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "guest")
+		})
+
+		Convey("Then the key is found without an alias", func() {
+			_, err := NewRSADecrypterFromKeyStore(keyStore, "letmein", "", "")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Then it is set up from the environment like the config server's encrypt.keyStore", func() {
+			os.Setenv("ENCRYPT_KEY_STORE_LOCATION", keyStore)
+			os.Setenv("ENCRYPT_KEY_STORE_PASSWORD", "letmein")
+			os.Setenv("ENCRYPT_KEY_STORE_ALIAS", "mytestkey")
+			defer os.Unsetenv("ENCRYPT_KEY_STORE_LOCATION")
+			defer os.Unsetenv("ENCRYPT_KEY_STORE_PASSWORD")
+			defer os.Unsetenv("ENCRYPT_KEY_STORE_ALIAS")
+			decrypter, err := NewDecrypterFromEnv()
+			So(err, ShouldBeNil)
+			plain, err := decrypter.Decrypt(rsaCipherText)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "guest")
+		})
+
+		Convey("Then a wrong password or alias is rejected", func() {
+			_, err := NewRSADecrypterFromKeyStore(keyStore, "wrong", "mytestkey", "")
+			So(err, ShouldNotBeNil)
+			_, err = NewRSADecrypterFromKeyStore(keyStore, "letmein", "otherkey", "")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then a JKS keystore is rejected with a hint to convert it", func() {
+			dir, _ := ioutil.TempDir("", "keystore")
+			defer os.RemoveAll(dir)
+			jks := filepath.Join(dir, "server.jks")
+			ioutil.WriteFile(jks, []byte{0xfe, 0xed, 0xfe, 0xed, 0, 0, 0, 2}, 0600)
+			_, err := NewRSADecrypterFromKeyStore(jks, "letmein", "mytestkey", "")
+			So(err.Error(), ShouldContainSubstring, "PKCS#12")
+		})
+	})
+
+	Convey("Given an unknown RSA algorithm", t, func() {
+		_, err := NewRSADecrypterFromFile("testdata/cipher-key.pem", "RSA/NONE")
+
+		Convey("Then no decrypter is made", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestLoadEncryptedValues(t *testing.T) {
+	Convey("Given configuration with encrypted values", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		defer log.SetOutput(os.Stderr)
+
+		opts := Options{
+			Offline: true,
+			Defaults: map[string]interface{}{
+				"amqp_password": "{cipher}" + symmetricCipherText,
+				"db_password":   "{cipher}{key:other}" + symmetricCipherText,
+				"bad_password":  "{cipher}00",
+				"server_port":   6767,
+			},
+			Decrypter: NewSymmetricDecrypter("foo"),
+		}
+
+		Convey("When it is loaded", func() {
+			So(Load(opts), ShouldBeNil)
+
+			Convey("Then the values are decrypted", func() {
+				So(viper.GetString("amqp_password"), ShouldEqual, "mysecret")
+				So(viper.GetString("db_password"), ShouldEqual, "mysecret")
+				So(IsSecret("amqp_password"), ShouldBeTrue)
+				So(IsSecret("server_port"), ShouldBeFalse)
+			})
+
+			Convey("Then values that can't be decrypted are left unset", func() {
+				So(viper.IsSet("bad_password"), ShouldBeFalse)
+			})
+
+			Convey("Then the secrets are not logged", func() {
+				So(logged.String(), ShouldContainSubstring, "amqp_password => ******")
+				So(logged.String(), ShouldNotContainSubstring, "mysecret")
+				So(logged.String(), ShouldNotContainSubstring, symmetricCipherText)
+			})
+		})
+	})
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// FetchTimeout bounds a single request to the config server.
+	FetchTimeout = 5 * time.Second
+	// FetchDeadline bounds all attempts to fetch the configuration, including backoff.
+	FetchDeadline = 30 * time.Second
+
+	// The wait between attempts starts at initialBackoff and doubles up to maxBackoff.
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 8 * time.Second
+
+	// CacheDir is where the last configuration successfully loaded from the config server is kept,
+	// to be used when the config server can't be reached. Set it to "" to disable the cache. The
+	// cache holds the response as it was received, so {cipher} values stay encrypted, but it is
+	// still only readable by the user running the service.
+	CacheDir = defaultCacheDir()
+)
+
+// defaultCacheDir is in the user's cache directory, e.g. ~/.cache, and only if there is none in the
+// shared temporary directory.
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "configcache")
+	}
+	return filepath.Join(os.TempDir(), "configcache")
+}
+
+// How much of an error response body is included in the error.
+const maxErrorBody = 512
+
+// fetchConfiguration gets url from the config server. Connection problems and 5xx responses are
+// retried with exponential backoff until FetchDeadline has passed; other responses aren't.
+func fetchConfiguration(url string) ([]byte, error) {
+	deadline := time.Now().Add(FetchDeadline)
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		log.Printf("Getting config from %v, attempt %v\n", url, attempt)
+		body, retry, err := fetchOnce(url)
+		if err == nil || !retry {
+			return body, err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("Giving up after %v attempts: %v", attempt, err)
+		}
+		log.Printf("Couldn't get config from %v, retrying in %v: %v\n", url, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func fetchOnce(url string) (body []byte, retry bool, err error) {
+	client := &http.Client{Timeout: FetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("Error reading configuration: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(body))
+		if len(message) > maxErrorBody {
+			message = message[:maxErrorBody] + "..."
+		}
+		return nil, resp.StatusCode >= 500, fmt.Errorf("Config server responded with %v: %v", resp.Status, message)
+	}
+	return body, false, nil
+}
+
+// cacheFile returns where the configuration of appName in profile and branch is cached.
+func cacheFile(appName string, profile string, branch string) string {
+	return filepath.Join(CacheDir, fmt.Sprintf("%s-%s-%s.json", appName, profile, branch))
+}
+
+// writeCache stores a config server response that has been parsed successfully. Failing to do so
+// only means there's nothing to fall back on next time, so it is just logged.
+func writeCache(file string, body []byte) {
+	if CacheDir == "" {
+		return
+	}
+	dir := filepath.Dir(file)
+	if err := privateDir(dir); err != nil {
+		log.Printf("Not caching configuration: %v\n", err)
+		return
+	}
+	// Write a new file and rename it, so a crash can't leave a half-written cache behind. TempFile
+	// creates it with mode 0600.
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		log.Printf("Couldn't cache configuration in %v: %v\n", file, err)
+		return
+	}
+	_, err = tmp.Write(body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Couldn't cache configuration in %v: %v\n", file, err)
+	}
+}
+
+// privateDir creates dir with mode 0700, or restricts an existing one to that. It fails for a
+// symlink, so a directory someone else created in a shared location can't be used.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Couldn't create config cache directory: %v", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Config cache %v is not a directory", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return fmt.Errorf("Couldn't restrict config cache directory %v: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+func readCache(file string) ([]byte, error) {
+	if CacheDir == "" {
+		return nil, fmt.Errorf("No config cache")
+	}
+	return ioutil.ReadFile(file)
+}
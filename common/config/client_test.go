@@ -0,0 +1,135 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFetchConfiguration(t *testing.T) {
+	initialBackoff = time.Millisecond
+	defer func() { initialBackoff = 500 * time.Millisecond }()
+
+	Convey("Given a config server that is unavailable for the first two requests", t, func() {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				http.Error(w, "Starting up", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(serverConfig))
+		}))
+		defer server.Close()
+
+		Convey("When the configuration is fetched", func() {
+			body, err := fetchConfiguration(server.URL + "/accountservice/test/master")
+
+			Convey("Then it is retried until it succeeds", func() {
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, serverConfig)
+				So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+			})
+		})
+	})
+
+	Convey("Given a config server that doesn't know the application", t, func() {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(w, `{"error":"Not Found"}`, http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		Convey("When the configuration is fetched", func() {
+			_, err := fetchConfiguration(server.URL + "/unknown/test/master")
+
+			Convey("Then it fails at once with the status and body in the error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "404 Not Found")
+				So(err.Error(), ShouldContainSubstring, `{"error":"Not Found"}`)
+				So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestConfigCache(t *testing.T) {
+	Convey("Given a configuration that was loaded from the config server before", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		CacheDir = filepath.Join(dir, "cache")
+		FetchDeadline = 0
+		defer func() { FetchDeadline = 30 * time.Second }()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(serverConfig))
+		}))
+		opts := Options{AppName: "accountservice", Profile: "test", Branch: "master", ConfigServerUrl: server.URL}
+		So(Load(opts), ShouldBeNil)
+		server.Close()
+
+		Convey("Then only the user running the service can read the cache", func() {
+			info, err := os.Stat(CacheDir)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+			info, err = os.Stat(cacheFile("accountservice", "test", "master"))
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("When the config server is down on the next start", func() {
+			viper.Reset()
+			err := Load(opts)
+
+			Convey("Then the last known good configuration is used", func() {
+				So(err, ShouldBeNil)
+				So(viper.GetInt("server_port"), ShouldEqual, 6767)
+				So(SourceOf("server_port"), ShouldEqual, SourceConfigCache)
+			})
+		})
+	})
+}
+
+func TestConfigCacheSecrets(t *testing.T) {
+	Convey("Given a config server response with an encrypted value", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		CacheDir = filepath.Join(dir, "cache")
+		// A cache directory that already exists, e.g. from an older version, is restricted too.
+		os.MkdirAll(CacheDir, 0755)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"name":"accountservice","propertySources":[{"name":"accountservice-test.yml",
+				"source":{"amqp_password":"{cipher}` + symmetricCipherText + `"}}]}`))
+		}))
+		defer server.Close()
+
+		Convey("When it is loaded", func() {
+			So(Load(Options{AppName: "accountservice", Profile: "test", Branch: "master", ConfigServerUrl: server.URL,
+				Decrypter: NewSymmetricDecrypter("foo")}), ShouldBeNil)
+
+			Convey("Then the value is decrypted, but cached encrypted", func() {
+				So(viper.GetString("amqp_password"), ShouldEqual, "mysecret")
+				cached, err := ioutil.ReadFile(cacheFile("accountservice", "test", "master"))
+				So(err, ShouldBeNil)
+				So(string(cached), ShouldContainSubstring, "{cipher}"+symmetricCipherText)
+				So(string(cached), ShouldNotContainSubstring, "mysecret")
+				info, _ := os.Stat(CacheDir)
+				So(info.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+			})
+		})
+	})
+}
@@ -2,9 +2,10 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
-	"strings"
 
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
 )
@@ -12,29 +13,73 @@ import (
 // {"type":"RefreshRemoteApplicationEvent","timestamp":1494514362123,"originService":"config-server:docker:8888","destinationService":"xxxaccoun:**","id":"53e61c71-cbae-4b6d-84bb-d0dcc0aeb4dc"}
 type UpdateToken struct {
 	Type               string `json:"type"`
-	Timestamp          int    `json:"timestamp"`
+	Timestamp          int64  `json:"timestamp"`
 	OriginService      string `json:"originService"`
 	DestinationService string `json:"destinationService"`
 	Id                 string `json:"id"`
 }
 
+// HandleRefreshEvent reloads the configuration when a refresh event on the bus is meant for this
+// instance. The consumer tag is used as application name.
 func HandleRefreshEvent(d amqp.Delivery) {
-	body := d.Body
+	handleRefreshEvent(d)
+}
+
+// RefreshEventHandler returns a handler that works like HandleRefreshEvent, and also publishes an
+// AckRemoteApplicationEvent on exchangeName for every refresh it has handled.
+func RefreshEventHandler(client messaging.IMessagingClient, exchangeName string) func(amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		updateToken, refreshed := handleRefreshEvent(d)
+		if !refreshed {
+			return
+		}
+		if err := publishAck(client, exchangeName, BusID(d.ConsumerTag), updateToken); err != nil {
+			log.Printf("Problem acknowledging refresh event %v: %v", updateToken.Id, err)
+		}
+	}
+}
+
+// handleRefreshEvent returns the event and true if the configuration was reloaded.
+func handleRefreshEvent(d amqp.Delivery) (UpdateToken, bool) {
 	consumerTag := d.ConsumerTag
-	updateToken := &UpdateToken{}
-	err := json.Unmarshal(body, updateToken)
+	updateToken := UpdateToken{}
+	err := json.Unmarshal(d.Body, &updateToken)
 	if err != nil {
 		log.Printf("Problem parsing UpdateToken: %v", err.Error())
-	} else {
-		if strings.Contains(updateToken.DestinationService, consumerTag) {
-			log.Println("Reloading Viper config from Spring Cloud Config server")
-
-			// Consumertag is same as application name.
-			LoadConfigurationFromBranch(
-				viper.GetString("configServerUrl"),
-				consumerTag,
-				viper.GetString("profile"),
-				viper.GetString("configBranch"))
-		}
+		return updateToken, false
+	}
+	// Everything on the bus arrives here, including acks from other instances and ourselves.
+	if updateToken.Type != refreshEventType {
+		return updateToken, false
+	}
+	busID := BusID(consumerTag)
+	if !MatchesDestination(updateToken.DestinationService, busID) {
+		return updateToken, false
+	}
+
+	log.Printf("Reloading Viper config from Spring Cloud Config server, %v matches %v", updateToken.DestinationService, busID)
+	// Consumertag is same as application name.
+	if err := refresh(consumerTag); err != nil {
+		log.Printf("Problem reloading configuration, keeping the current one: %v", err)
+		return updateToken, false
+	}
+	return updateToken, true
+}
+
+// refresh reloads the configuration, with Reload if it was loaded with Load and from the config
+// server otherwise.
+func refresh(appName string) error {
+	reloaded, err := Reload()
+	if err != nil || reloaded {
+		return err
+	}
+	if appName == "" {
+		return fmt.Errorf("Configuration wasn't loaded with Load, don't know what to refresh")
 	}
+	LoadConfigurationFromBranch(
+		viper.GetString("configServerUrl"),
+		appName,
+		viper.GetString("profile"),
+		viper.GetString("configBranch"))
+	return nil
 }
@@ -0,0 +1,367 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Source tells which layer an effective configuration value came from.
+type Source string
+
+// The layers, from lowest to highest precedence.
+const (
+	SourceDefault      Source = "default"
+	SourceFile         Source = "file"
+	SourceConfigServer Source = "configserver"
+	SourceConfigCache  Source = "configserver-cache" // Same layer, when the config server was down
+	SourceEnv          Source = "env"
+	SourceFlag         Source = "flag"
+)
+
+// Options describes where Load gets the configuration of a service from.
+type Options struct {
+	AppName         string
+	Profile         string
+	Branch          string
+	ConfigServerUrl string
+
+	// Offline skips the config server, so a service can start with only defaults, a local file,
+	// environment variables and flags.
+	Offline bool
+
+	// ConfigFile is an optional local YAML or JSON file, picked by its extension.
+	ConfigFile string
+
+	Defaults map[string]interface{}
+
+	// Flags that were set explicitly on the command line override everything else, keyed by
+	// flag name. Any key can be set with the repeatable -set key=value flag, see SetFlag.
+	// Defaults to flag.CommandLine.
+	Flags *flag.FlagSet
+
+	// Decrypter decrypts {cipher} values. Defaults to NewDecrypterFromEnv.
+	Decrypter Decrypter
+}
+
+type layer struct {
+	source Source
+	values map[string]interface{}
+}
+
+// SetFlagName is the flag that sets config keys from the command line, registered on
+// flag.CommandLine. It can be repeated, e.g. -set server_port=7070 -set log_level=debug.
+const SetFlagName = "set"
+
+// SetFlag collects the key=value pairs of a repeatable flag. Load gives them the precedence of
+// flags when the flag is part of Options.Flags.
+type SetFlag map[string]string
+
+func (f SetFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f SetFlag) Set(pair string) error {
+	i := strings.Index(pair, "=")
+	if i < 1 {
+		return fmt.Errorf("'%v' is not key=value", pair)
+	}
+	f[strings.ToLower(pair[:i])] = pair[i+1:]
+	return nil
+}
+
+func init() {
+	flag.Var(SetFlag{}, SetFlagName, "Set a config key, overriding all other sources, as key=value. Can be repeated.")
+}
+
+var (
+	// Held while loading and applying configuration, so concurrent refreshes, e.g. from the bus and
+	// /admin/config/refresh, are applied one after the other.
+	loadLock sync.Mutex
+
+	sourcesLock sync.RWMutex
+	sources     = make(map[string]Source)
+	secrets     = make(map[string]bool)
+	updated     = make(map[string]time.Time)           // When the value of a key last changed
+	refreshed   time.Time                              // When the configuration was last applied
+	declared    = map[string]bool{AdminTokenKey: true} // Keys of structs passed to Bind
+	loaded      *Options
+)
+
+// Load reads the configuration from all layers and sets the effective value of each key in Viper.
+// From lowest to highest precedence: defaults, the local file, the config server, environment
+// variables and flags. A key that is set by one of the first three layers, or bound with Bind, is
+// set by the environment variable with the upper-cased key name, with dots replaced by
+// underscores, e.g. AMQP_SERVER_URL for amqp_server_url. Keys that an earlier Load set but no
+// layer sets any more are unset.
+func Load(opts Options) error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+
+	layers := []layer{{SourceDefault, opts.Defaults}}
+
+	if opts.ConfigFile != "" {
+		values, err := readConfigFile(opts.ConfigFile)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, layer{SourceFile, values})
+	}
+
+	if opts.Offline {
+		log.Println("Running offline, not loading configuration from the config server")
+	} else {
+		l, err := loadFromConfigServer(opts)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, l)
+	}
+
+	values, keySources := merge(layers)
+	for _, key := range envKeys(values) {
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			values[key] = value
+			keySources[key] = SourceEnv
+		}
+	}
+
+	flags := opts.Flags
+	if flags == nil {
+		flags = flag.CommandLine
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if pairs, ok := f.Value.(SetFlag); ok {
+			for key, value := range pairs {
+				values[key] = value
+				keySources[key] = SourceFlag
+			}
+			return
+		}
+		key := strings.ToLower(f.Name)
+		values[key] = f.Value.String()
+		keySources[key] = SourceFlag
+	})
+
+	decrypter, err := decrypterFor(&opts)
+	if err != nil {
+		return err
+	}
+	secretKeys := decryptValues(values, decrypter)
+
+	apply(values, keySources, secretKeys, true)
+
+	sourcesLock.Lock()
+	loaded = &opts
+	sourcesLock.Unlock()
+	return nil
+}
+
+// Reload loads the configuration again with the options of the last successful Load. It returns
+// false if Load hasn't been used.
+func Reload() (bool, error) {
+	sourcesLock.RLock()
+	opts := loaded
+	sourcesLock.RUnlock()
+	if opts == nil {
+		return false, nil
+	}
+	return true, Load(*opts)
+}
+
+// declare makes Load look up keys in the environment from now on, even if no other layer sets
+// them. The environment variables of keys that aren't set yet are applied right away.
+func declare(keys []string) error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+
+	values := make(map[string]interface{})
+	keySources := make(map[string]Source)
+	sourcesLock.Lock()
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		declared[key] = true
+		if viper.IsSet(key) {
+			continue
+		}
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			values[key] = value
+			keySources[key] = SourceEnv
+		}
+	}
+	opts := loaded
+	sourcesLock.Unlock()
+	if len(values) == 0 {
+		return nil
+	}
+
+	decrypter, err := decrypterFor(opts)
+	if err != nil {
+		return err
+	}
+	apply(values, keySources, decryptValues(values, decrypter), false)
+	return nil
+}
+
+// envKeys returns the keys to look up in the environment: those in values and the declared ones.
+func envKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sourcesLock.RLock()
+	defer sourcesLock.RUnlock()
+	for key := range declared {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// decrypterFor returns the decrypter of opts, or else the one set up in the environment.
+func decrypterFor(opts *Options) (Decrypter, error) {
+	if opts != nil && opts.Decrypter != nil {
+		return opts.Decrypter, nil
+	}
+	return NewDecrypterFromEnv()
+}
+
+// loadFromConfigServer fetches the configuration from the config server, and caches it on disk.
+// If the config server can't be reached, the last cached configuration is used instead.
+func loadFromConfigServer(opts Options) (layer, error) {
+	url := fmt.Sprintf("%s/%s/%s/%s", opts.ConfigServerUrl, opts.AppName, opts.Profile, opts.Branch)
+	cache := cacheFile(opts.AppName, opts.Profile, opts.Branch)
+
+	body, err := fetchConfiguration(url)
+	if err == nil {
+		values, err := parsePropertySources(body)
+		if err != nil {
+			return layer{}, fmt.Errorf("Bad configuration from %v: %v", url, err)
+		}
+		writeCache(cache, body)
+		return layer{SourceConfigServer, values}, nil
+	}
+
+	body, cacheErr := readCache(cache)
+	if cacheErr != nil {
+		return layer{}, fmt.Errorf("Couldn't load configuration from %v: %v", url, err)
+	}
+	log.Printf("Couldn't load configuration from %v, using the last known good one from %v: %v\n", url, cache, err)
+	values, err := parsePropertySources(body)
+	if err != nil {
+		return layer{}, fmt.Errorf("Bad cached configuration in %v: %v", cache, err)
+	}
+	return layer{SourceConfigCache, values}, nil
+}
+
+// IsSecret reports whether the value of key was encrypted, and must not be shown.
+func IsSecret(key string) bool {
+	sourcesLock.RLock()
+	defer sourcesLock.RUnlock()
+	return secrets[strings.ToLower(key)]
+}
+
+// SourceOf returns which layer the effective value of key came from, or "" for keys not set by
+// Load.
+func SourceOf(key string) Source {
+	sourcesLock.RLock()
+	defer sourcesLock.RUnlock()
+	return sources[strings.ToLower(key)]
+}
+
+func merge(layers []layer) (map[string]interface{}, map[string]Source) {
+	values := make(map[string]interface{})
+	keySources := make(map[string]Source)
+	for _, l := range layers {
+		for key, value := range l.values {
+			key = strings.ToLower(key)
+			values[key] = value
+			keySources[key] = l.source
+		}
+	}
+	return values, keySources
+}
+
+// apply sets values in Viper and notifies bound structs and watchers of the changes. If complete,
+// values is the whole configuration, and keys set by an earlier Load that it lacks are unset.
+// Callers must hold loadLock.
+func apply(values map[string]interface{}, keySources map[string]Source, secretKeys map[string]bool, complete bool) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	removed := make([]string, 0)
+	if complete {
+		sourcesLock.RLock()
+		for key := range sources {
+			if _, ok := values[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		sourcesLock.RUnlock()
+	}
+	sort.Strings(keys)
+	sort.Strings(removed)
+	changes := changedValues(values, append(append([]string{}, keys...), removed...))
+
+	now := time.Now()
+	sourcesLock.Lock()
+	for _, c := range changes {
+		updated[c.key] = now
+	}
+	refreshed = now
+	for _, key := range keys {
+		viper.Set(key, values[key])
+		sources[key] = keySources[key]
+		secrets[key] = secretKeys[key]
+		log.Printf("Loading config property %v => %v (from %v)\n", key, logValue(key, values[key], secretKeys), keySources[key])
+	}
+	for _, key := range removed {
+		// Viper can't forget a key, but treats one set to nil as not set.
+		viper.Set(key, nil)
+		delete(sources, key)
+		delete(secrets, key)
+		delete(updated, key)
+		log.Printf("Removing config property %v, no source sets it any more\n", key)
+	}
+	sourcesLock.Unlock()
+
+	rebind()
+	notifyWatchers(changes)
+}
+
+// readConfigFile returns the contents of a YAML or JSON file as flat, dot-separated keys.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Couldn't read config file %v: %v", path, err)
+	}
+	values := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		values[key] = v.Get(key)
+	}
+	return values, nil
+}
+
+func envName(key string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// logValue returns value masked as in Report.
+func logValue(key string, value interface{}, secretKeys map[string]bool) interface{} {
+	return maskValue(key, value, secretKeys[key])
+}
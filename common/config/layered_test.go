@@ -0,0 +1,174 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const serverConfig = `{"name":"accountservice","profiles":["test"],"label":"master","propertySources":[
+	{"name":"accountservice-test.yml","source":{"server_port":6767,"amqp_server_url":"amqp://server","config_event_bus":"springCloudBus"}}]}`
+
+func TestLayeredLoad(t *testing.T) {
+	Convey("Given a value for some keys in every layer", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+
+		var inFlight, maxInFlight int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/accountservice/test/master" {
+				http.NotFound(w, r)
+				return
+			}
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for m := atomic.LoadInt32(&maxInFlight); n > m && !atomic.CompareAndSwapInt32(&maxInFlight, m, n); {
+				m = atomic.LoadInt32(&maxInFlight)
+			}
+			time.Sleep(5 * time.Millisecond)
+			w.Write([]byte(serverConfig))
+		}))
+		defer server.Close()
+
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		CacheDir = filepath.Join(dir, "cache")
+		FetchDeadline = 0 // No retries
+		defer func() { FetchDeadline = 30 * time.Second }()
+		file := filepath.Join(dir, "accountservice.yml")
+		ioutil.WriteFile(file, []byte("server_port: 7000\nlog_level: debug\nzipkin_server_url: http://file\n"), 0644)
+
+		os.Setenv("ZIPKIN_SERVER_URL", "http://env")
+		defer os.Unsetenv("ZIPKIN_SERVER_URL")
+
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.String("amqp_server_url", "", "")
+		flags.String("unused", "", "")
+		flags.Var(SetFlag{}, SetFlagName, "")
+		flags.Parse([]string{"-amqp_server_url", "amqp://flag", "-set", "Server_Name=from-set", "-set", "hystrix.command.x.timeout=100"})
+
+		opts := Options{
+			AppName:         "accountservice",
+			Profile:         "test",
+			Branch:          "master",
+			ConfigServerUrl: server.URL,
+			ConfigFile:      file,
+			Defaults:        map[string]interface{}{"log_level": "info", "server_name": "accountservice"},
+			Flags:           flags,
+		}
+
+		Convey("When the configuration is loaded", func() {
+			err := Load(opts)
+
+			Convey("Then each key gets its value from the highest layer that sets it", func() {
+				So(err, ShouldBeNil)
+				So(viper.GetString("log_level"), ShouldEqual, "debug")
+				So(SourceOf("log_level"), ShouldEqual, SourceFile)
+				So(viper.GetInt("server_port"), ShouldEqual, 6767)
+				So(SourceOf("server_port"), ShouldEqual, SourceConfigServer)
+				So(viper.GetString("zipkin_server_url"), ShouldEqual, "http://env")
+				So(SourceOf("zipkin_server_url"), ShouldEqual, SourceEnv)
+				So(viper.GetString("amqp_server_url"), ShouldEqual, "amqp://flag")
+				So(SourceOf("amqp_server_url"), ShouldEqual, SourceFlag)
+				So(viper.IsSet("unused"), ShouldBeFalse)
+			})
+
+			Convey("Then any key can be set with -set", func() {
+				So(viper.GetString("server_name"), ShouldEqual, "from-set")
+				So(SourceOf("server_name"), ShouldEqual, SourceFlag)
+				So(viper.GetInt("hystrix.command.x.timeout"), ShouldEqual, 100)
+				So(SourceOf("hystrix.command.x.timeout"), ShouldEqual, SourceFlag)
+			})
+		})
+
+		Convey("When a refresh no longer finds a key", func() {
+			opts.Defaults["removed_key"] = "before"
+			So(Load(opts), ShouldBeNil)
+			var removed []interface{}
+			Watch("removed_key", func(key string, oldValue interface{}, newValue interface{}) {
+				removed = []interface{}{oldValue, newValue}
+			})
+			delete(opts.Defaults, "removed_key")
+			So(Load(opts), ShouldBeNil)
+
+			Convey("Then the key is unset", func() {
+				So(viper.IsSet("removed_key"), ShouldBeFalse)
+				So(SourceOf("removed_key"), ShouldEqual, Source(""))
+				So(Report().Properties, ShouldNotContainKey, "removed_key")
+				So(removed, ShouldResemble, []interface{}{"before", nil})
+			})
+		})
+
+		Convey("When refreshes run concurrently", func() {
+			errs := make(chan error, 8)
+			for i := 0; i < 8; i++ {
+				go func() { errs <- Load(opts) }()
+			}
+
+			Convey("Then they run one after the other", func() {
+				for i := 0; i < 8; i++ {
+					So(<-errs, ShouldBeNil)
+				}
+				So(atomic.LoadInt32(&maxInFlight), ShouldEqual, 1)
+				So(viper.GetInt("server_port"), ShouldEqual, 6767)
+			})
+		})
+
+		Convey("When the config server is unreachable", func() {
+			opts.ConfigServerUrl = "http://127.0.0.1:1"
+
+			Convey("Then loading fails", func() {
+				So(Load(opts), ShouldNotBeNil)
+			})
+
+			Convey("Then loading offline still works", func() {
+				opts.Offline = true
+				So(Load(opts), ShouldBeNil)
+				So(viper.GetInt("server_port"), ShouldEqual, 7000)
+				So(SourceOf("server_port"), ShouldEqual, SourceFile)
+			})
+		})
+	})
+}
+
+func TestEnvironmentOnlyKeys(t *testing.T) {
+	Convey("Given a required key that is only set in the environment", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		os.Setenv("ENV_ONLY_BROKER_URL", "amqp://env")
+		defer os.Unsetenv("ENV_ONLY_BROKER_URL")
+
+		type envOnlyConfig struct {
+			BrokerUrl string `config:"env_only_broker_url" validate:"required,url"`
+		}
+		cfg := envOnlyConfig{}
+
+		Convey("When a service starts offline without a config file", func() {
+			So(Load(Options{AppName: "accountservice", Offline: true, Flags: flag.NewFlagSet("test", flag.ContinueOnError)}), ShouldBeNil)
+			binding, err := Bind(&cfg)
+
+			Convey("Then the key is bound from the environment", func() {
+				So(err, ShouldBeNil)
+				So(cfg.BrokerUrl, ShouldEqual, "amqp://env")
+				So(SourceOf("env_only_broker_url"), ShouldEqual, SourceEnv)
+			})
+
+			Convey("Then a reload picks up changes to it", func() {
+				os.Setenv("ENV_ONLY_BROKER_URL", "amqp://changed")
+				_, err := Reload()
+				So(err, ShouldBeNil)
+				So(binding.Get().(*envOnlyConfig).BrokerUrl, ShouldEqual, "amqp://changed")
+			})
+		})
+	})
+}
@@ -3,9 +3,11 @@ package config
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -33,36 +35,92 @@ func LoadConfigurationFromBranch(configServerUrl string, appName string, profile
 	parseConfiguration(body)
 }
 
-func fetchConfiguration(url string) ([]byte, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered in f", r)
-		}
-	}()
-	log.Printf("Getting config from %v\n", url)
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != 200 {
-		panic("Couldn't load configuration, cannot start. Terminating. Error: " + err.Error())
+func parseConfiguration(body []byte) {
+	values, err := parsePropertySources(body)
+	if err != nil {
+		panic(err.Error())
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	decrypter, err := NewDecrypterFromEnv()
 	if err != nil {
-		panic("Error reading configuration: " + err.Error())
+		panic(err.Error())
+	}
+	secretKeys := decryptValues(values, decrypter)
+
+	for key, value := range values {
+		viper.Set(key, value)
+		log.Printf("Loading config property %v => %v\n", key, logValue(key, value, secretKeys))
+	}
+	if viper.IsSet("server_name") {
+		log.Printf("Successfully loaded configuration for service %s\n", viper.GetString("server_name"))
 	}
-	return body, err
 }
 
-func parseConfiguration(body []byte) {
+// parsePropertySources merges all property sources of a config server response into a single map
+// with lower-cased, dot-separated keys. The config server lists the sources with the highest
+// precedence first, e.g. accountservice-test.yml before accountservice.yml before application.yml.
+// Like in Spring, a list set by a source replaces the whole list of sources further down.
+func parsePropertySources(body []byte) (map[string]interface{}, error) {
 	var cloudConfig springCloudConfig
 	err := json.Unmarshal(body, &cloudConfig)
 	if err != nil {
-		panic("Cannot parse configuration, message: " + err.Error())
+		return nil, fmt.Errorf("Cannot parse configuration, message: %v", err)
+	}
+	values := make(map[string]interface{})
+	for i := len(cloudConfig.PropertySources) - 1; i >= 0; i-- {
+		sourceValues := make(map[string]interface{})
+		flatten("", cloudConfig.PropertySources[i].Source, sourceValues)
+		for key, value := range collapseLists(sourceValues) {
+			values[key] = value
+		}
 	}
+	return values, nil
+}
 
-	for key, value := range cloudConfig.PropertySources[0].Source {
-		viper.Set(key, value)
-		log.Printf("Loading config property %v => %v\n", key, value)
+// Matches the keys the config server uses for list elements, e.g. trace_propagation[1].
+var indexedKey = regexp.MustCompile(`^(.+)\[(\d+)\]$`)
+
+// collapseLists turns the indexed keys of list elements into a single key holding a slice, so
+// trace_propagation[0] and trace_propagation[1] become trace_propagation. Lists of objects, with
+// keys such as routes[0].path, are left as they are.
+func collapseLists(values map[string]interface{}) map[string]interface{} {
+	elements := make(map[string]map[int]interface{})
+	collapsed := make(map[string]interface{})
+	for key, value := range values {
+		match := indexedKey.FindStringSubmatch(key)
+		if match == nil {
+			collapsed[key] = value
+			continue
+		}
+		index, _ := strconv.Atoi(match[2])
+		if elements[match[1]] == nil {
+			elements[match[1]] = make(map[int]interface{})
+		}
+		elements[match[1]][index] = value
 	}
-	if viper.IsSet("server_name") {
-		log.Printf("Successfully loaded configuration for service %s\n", viper.GetString("server_name"))
+	for key, byIndex := range elements {
+		indexes := make([]int, 0, len(byIndex))
+		for index := range byIndex {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		list := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			list[i] = byIndex[index]
+		}
+		collapsed[key] = list
+	}
+	return collapsed
+}
+
+// flatten adds the leaf values of source to values, so that nested and dot-separated keys for the
+// same property end up as the same key, e.g. hystrix.command.X.Timeout.
+func flatten(prefix string, source map[string]interface{}, values map[string]interface{}) {
+	for key, value := range source {
+		key = strings.ToLower(prefix + key)
+		if nested, ok := value.(map[string]interface{}); ok {
+			flatten(key+".", nested, values)
+			continue
+		}
+		values[key] = value
 	}
 }
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func recordedResponse(name string) []byte {
+	body, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func TestParsePropertySources(t *testing.T) {
+	Convey("Given a response with profile-specific, application and shared property sources", t, func() {
+		body := recordedResponse("accountservice-test.json")
+
+		Convey("When it is parsed", func() {
+			values, err := parsePropertySources(body)
+
+			Convey("Then sources listed first take precedence", func() {
+				So(err, ShouldBeNil)
+				So(values["server_port"], ShouldEqual, 6767)
+				So(values["server_name"], ShouldEqual, "Accountservice TEST")
+				So(values["hystrix.command.imageservice.timeout"], ShouldEqual, 5000)
+			})
+
+			Convey("Then keys only found further down are kept", func() {
+				So(values["hystrix.command.imageservice.sleepwindow"], ShouldEqual, 2000)
+				So(values["config_event_bus"], ShouldEqual, "springCloudBus")
+			})
+
+			Convey("Then nested values are flattened to dot-separated keys", func() {
+				So(values["hystrix.command.quotes-service.timeout"], ShouldEqual, 3000)
+				So(values, ShouldNotContainKey, "hystrix")
+			})
+		})
+
+		Convey("When it is loaded into Viper", func() {
+			viper.Reset()
+			defer viper.Reset()
+			parseConfiguration(body)
+
+			Convey("Then nested Viper paths resolve", func() {
+				So(viper.IsSet("hystrix.command.imageservice.Timeout"), ShouldBeTrue)
+				So(viper.GetInt("hystrix.command.imageservice.Timeout"), ShouldEqual, 5000)
+				So(viper.GetInt("hystrix.command.quotes-service.Timeout"), ShouldEqual, 3000)
+			})
+		})
+	})
+
+	Convey("Given a response with lists, which the config server sends as indexed keys", t, func() {
+		body := recordedResponse("vipservice-test.json")
+
+		Convey("When it is parsed", func() {
+			values, err := parsePropertySources(body)
+
+			Convey("Then the elements are collapsed into a list", func() {
+				So(err, ShouldBeNil)
+				So(values["services"], ShouldResemble, []interface{}{"imageservice", "quotes-service"})
+				So(values, ShouldNotContainKey, "services[0]")
+			})
+
+			Convey("Then a list replaces the whole list of sources further down", func() {
+				So(values["trace_propagation"], ShouldResemble, []interface{}{"tracecontext", "b3multi"})
+			})
+
+			Convey("Then lists of objects are left as they are", func() {
+				So(values["routes[0].path"], ShouldEqual, "/accounts")
+			})
+		})
+
+		Convey("When it is bound", func() {
+			viper.Reset()
+			defer viper.Reset()
+			parseConfiguration(body)
+			var cfg struct {
+				TracePropagation   []string `config:"trace_propagation"`
+				TraceSamplerRoutes []string `config:"trace_sampler_routes"`
+			}
+			_, err := Bind(&cfg)
+
+			Convey("Then the lists fill []string fields", func() {
+				So(err, ShouldBeNil)
+				So(cfg.TracePropagation, ShouldResemble, []string{"tracecontext", "b3multi"})
+				So(cfg.TraceSamplerRoutes, ShouldResemble, []string{"/health=never", "/vip/*=ratio:0.5"})
+			})
+		})
+	})
+
+	Convey("Given a response without property sources", t, func() {
+		body := recordedResponse("unknown-profile.json")
+
+		Convey("Then it parses to an empty configuration", func() {
+			values, err := parsePropertySources(body)
+			So(err, ShouldBeNil)
+			So(len(values), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a response that isn't JSON", t, func() {
+		Convey("Then an error is returned", func() {
+			_, err := parsePropertySources([]byte("<html>Bad gateway</html>"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// WatchFunc is called with the previous and the new value of a key that changed. The old value is
+// nil for keys that weren't set before.
+type WatchFunc func(key string, oldValue interface{}, newValue interface{})
+
+type watcher struct {
+	prefix string
+	fn     WatchFunc
+	batch  func(keys []string)
+}
+
+type change struct {
+	key      string
+	oldValue interface{}
+	newValue interface{}
+}
+
+var (
+	watchersLock sync.RWMutex
+	watchers     []watcher
+)
+
+// Watch registers fn to be called for every key starting with prefix whose value is changed by
+// Load or Reload. Keys are lower-case, so "hystrix.command." matches
+// hystrix.command.imageservice.Timeout. Callbacks run after all keys have been set in Viper, on
+// the goroutine that loaded the configuration.
+func Watch(prefix string, fn WatchFunc) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	watchers = append(watchers, watcher{prefix: strings.ToLower(prefix), fn: fn})
+}
+
+// WatchKeys calls fn once per Load or Reload with all keys starting with prefix that it changed, so
+// settings made up of several keys can be applied in one go.
+func WatchKeys(prefix string, fn func(keys []string)) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	watchers = append(watchers, watcher{prefix: strings.ToLower(prefix), batch: fn})
+}
+
+// WatchString calls fn with the old and new value of key as strings whenever it changes.
+func WatchString(key string, fn func(oldValue string, newValue string)) {
+	key = strings.ToLower(key)
+	Watch(key, func(changed string, oldValue interface{}, newValue interface{}) {
+		if changed == key {
+			fn(cast.ToString(oldValue), cast.ToString(newValue))
+		}
+	})
+}
+
+// WatchInt calls fn with the old and new value of key as ints whenever it changes.
+func WatchInt(key string, fn func(oldValue int, newValue int)) {
+	key = strings.ToLower(key)
+	Watch(key, func(changed string, oldValue interface{}, newValue interface{}) {
+		if changed == key {
+			fn(cast.ToInt(oldValue), cast.ToInt(newValue))
+		}
+	})
+}
+
+// changedValues returns the keys in values that have another value in Viper. Must be called before
+// values are set.
+func changedValues(values map[string]interface{}, keys []string) []change {
+	changes := make([]change, 0)
+	for _, key := range keys {
+		var oldValue interface{}
+		if viper.IsSet(key) {
+			oldValue = viper.Get(key)
+		}
+		if !reflect.DeepEqual(oldValue, values[key]) {
+			changes = append(changes, change{key: key, oldValue: oldValue, newValue: values[key]})
+		}
+	}
+	return changes
+}
+
+func notifyWatchers(changes []change) {
+	watchersLock.RLock()
+	registered := watchers
+	watchersLock.RUnlock()
+
+	for _, c := range changes {
+		for _, w := range registered {
+			if w.fn != nil && strings.HasPrefix(c.key, w.prefix) {
+				w.fn(c.key, c.oldValue, c.newValue)
+			}
+		}
+	}
+	for _, w := range registered {
+		if w.batch == nil {
+			continue
+		}
+		keys := make([]string, 0)
+		for _, c := range changes {
+			if strings.HasPrefix(c.key, w.prefix) {
+				keys = append(keys, c.key)
+			}
+		}
+		if len(keys) > 0 {
+			w.batch(keys)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWatch(t *testing.T) {
+	Convey("Given watchers for a prefix and for a single key", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		opts := Options{
+			Offline:  true,
+			Defaults: map[string]interface{}{"watchtest.a": 1, "watchtest.b": "x", "watchtest.retries": 3},
+		}
+		So(Load(opts), ShouldBeNil)
+
+		changed := make(map[string][]interface{})
+		Watch("watchTest.", func(key string, oldValue interface{}, newValue interface{}) {
+			changed[key] = []interface{}{oldValue, newValue}
+		})
+		var batches [][]string
+		WatchKeys("watchtest.", func(keys []string) {
+			batches = append(batches, keys)
+		})
+		var retries []int
+		WatchInt("watchtest.retries", func(oldValue int, newValue int) {
+			retries = []int{oldValue, newValue}
+		})
+
+		Convey("When a reload changes some of the keys", func() {
+			opts.Defaults = map[string]interface{}{"watchtest.a": 2, "watchtest.b": "x", "watchtest.retries": "5", "watchtest.c": true}
+			So(Load(opts), ShouldBeNil)
+
+			Convey("Then the prefix watcher gets the old and new value of each changed key", func() {
+				So(changed["watchtest.a"], ShouldResemble, []interface{}{1, 2})
+				So(changed["watchtest.c"], ShouldResemble, []interface{}{nil, true})
+				So(changed, ShouldNotContainKey, "watchtest.b")
+			})
+
+			Convey("Then the keys watcher is called once with all changed keys", func() {
+				So(batches, ShouldHaveLength, 1)
+				So(batches[0], ShouldHaveLength, 3)
+				So(batches[0], ShouldContain, "watchtest.a")
+				So(batches[0], ShouldContain, "watchtest.retries")
+				So(batches[0], ShouldContain, "watchtest.c")
+			})
+
+			Convey("Then the typed watcher gets converted values", func() {
+				So(retries, ShouldResemble, []int{3, 5})
+			})
+		})
+
+		Convey("When a reload changes nothing", func() {
+			So(Load(opts), ShouldBeNil)
+
+			Convey("Then the keys watcher isn't called", func() {
+				So(batches, ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// ServiceName is added to every entry FromContext returns. Services set it at startup.
+var ServiceName string
+
+// RequestIDHeader carries the request ID between services.
+const RequestIDHeader = "X-Request-ID"
+
+// The fields FromContext adds, so logs can be joined with the traces in Zipkin.
+const (
+	FieldService   = "service"
+	FieldTraceID   = "trace_id"
+	FieldSpanID    = "span_id"
+	FieldRequestID = "request_id"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+
+// FromContext returns a logger for what is done on behalf of ctx. Its entries carry the service
+// name, the trace and span IDs of the span within ctx, and the request ID, for those that are
+// known.
+func FromContext(ctx context.Context) *logrus.Entry {
+	fields := logrus.Fields{}
+	if ServiceName != "" {
+		fields[FieldService] = ServiceName
+	}
+	if ctx == nil {
+		return logrus.WithFields(fields)
+	}
+	if traceID, spanID := tracing.SpanIDs(tracing.SpanFromContext(ctx)); traceID != "" {
+		fields[FieldTraceID] = traceID
+		fields[FieldSpanID] = spanID
+	}
+	if id := RequestID(ctx); id != "" {
+		fields[FieldRequestID] = id
+	}
+	return logrus.WithFields(fields)
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID within ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// RequestIDMiddleware puts the request ID of every request in its context, and in the response.
+// The ID comes from the X-Request-ID header of the caller, or is made up for requests from outside.
+// Use it with router.Use.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// AddRequestIDToReq passes the request ID within ctx, if any, on to an OUTGOING HTTP request.
+func AddRequestIDToReq(ctx context.Context, req *http.Request) {
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
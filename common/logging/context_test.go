@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// b3Injector writes the IDs of mock spans as B3 headers, like the real tracers do.
+type b3Injector struct{}
+
+func (b3Injector) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	writer := carrier.(opentracing.TextMapWriter)
+	writer.Set("X-B3-TraceId", fmt.Sprintf("%016x", sc.TraceID))
+	writer.Set("X-B3-SpanId", fmt.Sprintf("%016x", sc.SpanID))
+	return nil
+}
+
+func TestFromContext(t *testing.T) {
+	Convey("Given a service with a tracer", t, func() {
+		ServiceName = "accountservice"
+		mock := mocktracer.New()
+		mock.RegisterInjector(opentracing.TextMap, b3Injector{})
+		tracing.SetTracer(mock)
+		defer tracing.SetTracer(opentracing.NoopTracer{})
+
+		Convey("When logging within a request with a span", func() {
+			span := mock.StartSpan("GetAccount")
+			ctx := tracing.UpdateContext(WithRequestID(context.Background(), "abc123"), span)
+			entry := FromContext(ctx)
+
+			Convey("Then the entry carries the service, trace, span and request", func() {
+				sc := span.Context().(mocktracer.MockSpanContext)
+				So(entry.Data[FieldService], ShouldEqual, "accountservice")
+				So(entry.Data[FieldTraceID], ShouldEqual, fmt.Sprintf("%016x", sc.TraceID))
+				So(entry.Data[FieldSpanID], ShouldEqual, fmt.Sprintf("%016x", sc.SpanID))
+				So(entry.Data[FieldRequestID], ShouldEqual, "abc123")
+			})
+		})
+
+		Convey("When logging outside of a request", func() {
+			entry := FromContext(context.Background())
+
+			Convey("Then the entry carries only the service", func() {
+				So(entry.Data, ShouldResemble, logrus.Fields{FieldService: "accountservice"})
+			})
+		})
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	Convey("Given a handler behind the request ID middleware", t, func() {
+		var seen string
+		handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = RequestID(r.Context())
+		}))
+
+		Convey("When the caller sends a request ID", func() {
+			req := httptest.NewRequest("GET", "/accounts/10000", nil)
+			req.Header.Set(RequestIDHeader, "abc123")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			Convey("Then it is used and echoed", func() {
+				So(seen, ShouldEqual, "abc123")
+				So(resp.Header().Get(RequestIDHeader), ShouldEqual, "abc123")
+			})
+
+			Convey("Then it is passed on to outgoing requests", func() {
+				out, _ := http.NewRequest("GET", "http://imageservice:7777/accounts/10000", nil)
+				AddRequestIDToReq(WithRequestID(context.Background(), seen), out)
+				So(out.Header.Get(RequestIDHeader), ShouldEqual, "abc123")
+			})
+		})
+
+		Convey("When the caller sends none", func() {
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, httptest.NewRequest("GET", "/accounts/10000", nil))
+
+			Convey("Then a new one is made up", func() {
+				So(len(seen), ShouldEqual, 16)
+				So(resp.Header().Get(RequestIDHeader), ShouldEqual, seen)
+			})
+		})
+	})
+}
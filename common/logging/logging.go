@@ -0,0 +1,116 @@
+// Package logging gives every service the same structured logger: logrus, writing JSON entries with
+// "msg", "level" and "time" that gelftail understands, tagged with the service name. Messages
+// written with the standard library log package end up there too.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The configuration keys ManageConfig applies.
+const (
+	// LevelConfigKey holds the logrus level of a service, e.g. "debug" or "warn".
+	LevelConfigKey = "log_level"
+	// FormatConfigKey holds FormatJSON or FormatText.
+	FormatConfigKey = "log_format"
+)
+
+// The formats log entries can be written in.
+const (
+	// FormatJSON is what gelftail reads, and the default.
+	FormatJSON = "json"
+	// FormatText is easier on the eye when running a service locally.
+	FormatText = "text"
+)
+
+var hookOnce sync.Once
+
+// Init makes logrus write JSON entries tagged with serviceName, and sends what is logged with the
+// standard library log package through it at info level. Services call it first thing in main.
+func Init(serviceName string) {
+	ServiceName = serviceName
+	hookOnce.Do(func() {
+		logrus.AddHook(serviceHook{})
+	})
+	SetFormat(FormatJSON)
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdlibWriter{})
+}
+
+// ManageConfig sets the level and format from LevelConfigKey and FormatConfigKey, and again
+// whenever they change.
+func ManageConfig() {
+	apply := func(key string, value string, set func(string) error) {
+		if value == "" {
+			return
+		}
+		if err := set(value); err != nil {
+			logrus.Errorf("Ignoring %v: %v", key, err)
+		}
+	}
+	apply(FormatConfigKey, viper.GetString(FormatConfigKey), SetFormat)
+	apply(LevelConfigKey, viper.GetString(LevelConfigKey), SetLevel)
+	config.WatchString(FormatConfigKey, func(oldValue string, newValue string) {
+		apply(FormatConfigKey, newValue, SetFormat)
+	})
+	config.WatchString(LevelConfigKey, func(oldValue string, newValue string) {
+		apply(LevelConfigKey, newValue, SetLevel)
+	})
+}
+
+// SetLevel changes the level of the logger, e.g. to "debug".
+func SetLevel(name string) error {
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+	logrus.Infof("Log level is %v", level)
+	return nil
+}
+
+// SetFormat changes the format of the logger to FormatJSON or FormatText.
+func SetFormat(name string) error {
+	switch strings.ToLower(name) {
+	case FormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000",
+			FullTimestamp:   true,
+		})
+	default:
+		return fmt.Errorf("Unknown log format '%v', use %v or %v", name, FormatJSON, FormatText)
+	}
+	return nil
+}
+
+// serviceHook tags every entry with ServiceName.
+type serviceHook struct{}
+
+func (serviceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (serviceHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data[FieldService]; !ok && ServiceName != "" {
+		entry.Data[FieldService] = ServiceName
+	}
+	return nil
+}
+
+// stdlibWriter logs each line written by the standard library log package as an info entry.
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	logrus.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
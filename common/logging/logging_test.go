@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInit(t *testing.T) {
+	Convey("Given a service that has initialized logging", t, func() {
+		buf := &bytes.Buffer{}
+		logrus.SetOutput(buf)
+		defer logrus.SetOutput(os.Stderr)
+		defer log.SetOutput(os.Stderr)
+		Init("vipservice")
+		SetLevel("info")
+		buf.Reset()
+
+		Convey("When it logs with the standard library", func() {
+			log.Printf("Got a %v message", "VipNotification")
+
+			Convey("Then a JSON entry gelftail understands is written", func() {
+				entry := map[string]interface{}{}
+				So(json.Unmarshal(buf.Bytes(), &entry), ShouldBeNil)
+				So(entry["msg"], ShouldEqual, "Got a VipNotification message")
+				So(entry["level"], ShouldEqual, "info")
+				So(entry[FieldService], ShouldEqual, "vipservice")
+			})
+		})
+
+		Convey("When the level is raised at runtime", func() {
+			So(SetLevel("warn"), ShouldBeNil)
+			buf.Reset()
+			logrus.Info("Not interesting")
+			logrus.Warn("Interesting")
+
+			Convey("Then only entries at that level are written", func() {
+				So(buf.String(), ShouldNotContainSubstring, "Not interesting")
+				So(buf.String(), ShouldContainSubstring, "Interesting")
+			})
+		})
+
+		Convey("When the format is changed to text", func() {
+			So(SetFormat(FormatText), ShouldBeNil)
+			defer SetFormat(FormatJSON)
+			buf.Reset()
+			logrus.Info("Readable")
+
+			Convey("Then entries are written as text", func() {
+				So(buf.String(), ShouldContainSubstring, `msg=Readable`)
+				So(buf.String(), ShouldContainSubstring, `service=vipservice`)
+			})
+		})
+
+		Convey("When an unknown level or format is given", func() {
+			Convey("Then it is refused", func() {
+				So(SetLevel("verbose"), ShouldNotBeNil)
+				So(SetFormat("xml"), ShouldNotBeNil)
+			})
+		})
+	})
+}
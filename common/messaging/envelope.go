@@ -0,0 +1,112 @@
+package messaging
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Header used to carry Envelope.Version. Everything else maps onto standard AMQP properties.
+const schemaVersionHeader = "x-schema-version"
+
+// Producer is stamped on every outgoing Envelope. Services should set it to their application name.
+var Producer = filepath.Base(os.Args[0])
+
+// Envelope is the metadata that travels with a typed message. The payload itself is kept as-is in
+// the message body, so consumers that only care about the JSON keep working.
+type Envelope struct {
+	Type          string
+	Version       int
+	MessageID     string
+	CorrelationID string
+	Producer      string
+	Timestamp     time.Time
+	ContentType   string
+	Body          []byte
+}
+
+// Publishing converts the envelope into an outgoing AMQP message.
+func (e Envelope) Publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Headers:       amqp.Table{schemaVersionHeader: int32(e.Version)},
+		ContentType:   e.ContentType,
+		MessageId:     e.MessageID,
+		Timestamp:     e.Timestamp,
+		Type:          e.Type,
+		AppId:         e.Producer,
+		CorrelationId: e.CorrelationID,
+		Body:          e.Body,
+	}
+}
+
+// EnvelopeFromDelivery reads the envelope of an incoming message. Messages without a type or
+// schema version were not published as typed messages and are rejected.
+func EnvelopeFromDelivery(d amqp.Delivery) (Envelope, error) {
+	if d.Type == "" {
+		return Envelope{}, fmt.Errorf("Message %v has no type", d.MessageId)
+	}
+	version, err := headerInt(d.Headers, schemaVersionHeader)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("Message %v of type %v: %v", d.MessageId, d.Type, err)
+	}
+	return Envelope{
+		Type:          d.Type,
+		Version:       version,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		Producer:      d.AppId,
+		Timestamp:     d.Timestamp,
+		ContentType:   d.ContentType,
+		Body:          d.Body,
+	}, nil
+}
+
+func headerInt(headers amqp.Table, name string) (int, error) {
+	switch v := headers[name].(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case nil:
+		return 0, fmt.Errorf("missing %v header", name)
+	default:
+		return 0, fmt.Errorf("header %v has unexpected type %T", name, v)
+	}
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying a correlation ID for messages published with it.
+func WithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, correlationID)
+}
+
+// CorrelationIDFromContext returns the correlation ID stored in ctx, or an empty string.
+func CorrelationIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// NewMessageID returns a random (version 4) UUID.
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("Unable to generate message id: " + err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,376 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// InMemoryBrokerURL can be used as amqp_server_url to run a service without a RabbitMQ broker.
+const InMemoryBrokerURL = "memory://"
+
+// NewMessagingClient returns an in-process broker for InMemoryBrokerURL and a RabbitMQ backed
+// client for everything else. ConnectToBroker must still be called on the returned client.
+func NewMessagingClient(connectionString string) IMessagingClient {
+	if strings.HasPrefix(connectionString, InMemoryBrokerURL) {
+		return &InMemoryMessagingClient{}
+	}
+	return &MessagingClient{}
+}
+
+// InMemoryMessagingClient is a functional in-process broker implementing IMessagingClient. It
+// supports fanout, topic and direct exchanges as well as named queues, using the same
+// declare/bind conventions as MessagingClient so the two can be swapped in tests and local runs.
+// The zero value is ready to use.
+type InMemoryMessagingClient struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	queueSeq  int
+	closed    bool
+	consumers sync.WaitGroup
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+}
+
+// memQueue is an unbounded FIFO. Several consumers on the same queue compete for messages,
+// just like they do on a real broker.
+type memQueue struct {
+	name        string
+	mu          sync.Mutex
+	cond        *sync.Cond
+	messages    []amqp.Delivery
+	deliveryTag uint64
+	closed      bool
+}
+
+func newMemQueue(name string) *memQueue {
+	q := &memQueue{name: name}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (m *InMemoryMessagingClient) ConnectToBroker(connectionString string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	log.Printf("Using in-memory broker instead of %v", connectionString)
+}
+
+func (m *InMemoryMessagingClient) Publish(body []byte, exchangeName string, exchangeType string) error {
+	return m.PublishMessage(amqp.Publishing{Body: body}, exchangeName, exchangeType)
+}
+
+func (m *InMemoryMessagingClient) PublishMessage(msg amqp.Publishing, exchangeName string, exchangeType string) error {
+	_, err := m.publishMessage(msg, exchangeName, exchangeType)
+	return err
+}
+
+// PublishMessageConfirmed works like PublishMessage, but like MessagingClient it is an error if
+// no queue is bound to receive the message.
+func (m *InMemoryMessagingClient) PublishMessageConfirmed(msg amqp.Publishing, exchangeName string, exchangeType string) error {
+	routed, err := m.publishMessage(msg, exchangeName, exchangeType)
+	if err == nil && routed == 0 {
+		return fmt.Errorf("Message %v to exchange %v was returned: %v %v", msg.MessageId, exchangeName, amqp.NoRoute, "NO_ROUTE")
+	}
+	return err
+}
+
+// publishMessage returns how many queues the message was routed to.
+func (m *InMemoryMessagingClient) publishMessage(msg amqp.Publishing, exchangeName string, exchangeType string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, fmt.Errorf("Cannot publish to exchange %v, client is closed", exchangeName)
+	}
+	ex, err := m.declareExchange(exchangeName, exchangeType)
+	if err != nil {
+		return 0, err
+	}
+	// Same convention as MessagingClient.Publish: the exchange name doubles as routing key.
+	d := toDelivery(msg, exchangeName, exchangeName)
+	routed := 0
+	for _, b := range ex.bindings {
+		if ex.routes(b.key, exchangeName) {
+			b.queue.push(d)
+			routed++
+		}
+	}
+	return routed, nil
+}
+
+func (m *InMemoryMessagingClient) PublishOnQueue(body []byte, queueName string) error {
+	return m.PublishMessageOnQueue(amqp.Publishing{ContentType: "application/json", Body: body}, queueName)
+}
+
+func (m *InMemoryMessagingClient) PublishMessageOnQueue(msg amqp.Publishing, queueName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return fmt.Errorf("Cannot publish to queue %v, client is closed", queueName)
+	}
+	q := m.declareQueue(queueName)
+	q.push(toDelivery(msg, "", queueName))
+	return nil
+}
+
+func (m *InMemoryMessagingClient) Subscribe(exchangeName string, exchangeType string, consumerName string, handlerFunc func(amqp.Delivery)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return fmt.Errorf("Cannot subscribe to exchange %v, client is closed", exchangeName)
+	}
+	ex, err := m.declareExchange(exchangeName, exchangeType)
+	if err != nil {
+		return err
+	}
+	q := m.declareQueue("")
+	ex.bindings = append(ex.bindings, memBinding{queue: q, key: exchangeName})
+
+	m.consumers.Add(1)
+	go func() {
+		defer m.consumers.Done()
+		q.consume(consumerName, handlerFunc)
+	}()
+	return nil
+}
+
+func (m *InMemoryMessagingClient) SubscribeToQueue(queueName string, consumerName string, handlerFunc func(amqp.Delivery)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return fmt.Errorf("Cannot subscribe to queue %v, client is closed", queueName)
+	}
+	q := m.declareQueue(queueName)
+
+	m.consumers.Add(1)
+	go func() {
+		defer m.consumers.Done()
+		q.consume(consumerName, handlerFunc)
+	}()
+	return nil
+}
+
+// SubscribeToQueueAcked is the same as SubscribeToQueue. In-memory consumers take the next message
+// off the queue once they have handled the last one, and there is nothing to acknowledge.
+func (m *InMemoryMessagingClient) SubscribeToQueueAcked(queueName string, consumerName string, prefetch int, handlerFunc func(amqp.Delivery)) error {
+	return m.SubscribeToQueue(queueName, consumerName, handlerFunc)
+}
+
+// DeclareTopology declares the exchanges, queues and bindings of topology. Redeclaring an exchange
+// with another type is an error. Queue arguments such as TTL and max-length are accepted but not
+// enforced.
+func (m *InMemoryMessagingClient) DeclareTopology(topology Topology) error {
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return fmt.Errorf("Cannot declare topology, client is closed")
+	}
+	for _, ex := range topology.Exchanges {
+		if _, err := m.declareExchange(ex.Name, ex.Type); err != nil {
+			return err
+		}
+	}
+	for _, q := range topology.Queues {
+		m.declareQueue(q.Name)
+	}
+	for _, b := range topology.Bindings {
+		ex := m.exchanges[b.Exchange]
+		ex.bindings = append(ex.bindings, memBinding{queue: m.queues[b.Queue], key: b.RoutingKey})
+	}
+	return nil
+}
+
+// Close stops all consumers. Messages that have not been delivered yet are dropped.
+func (m *InMemoryMessagingClient) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, q := range m.queues {
+		q.close()
+	}
+}
+
+// Shutdown stops all consumers and waits for handlers that are already running to return, or for
+// ctx to expire.
+func (m *InMemoryMessagingClient) Shutdown(ctx context.Context) error {
+	m.Close()
+
+	done := make(chan struct{})
+	go func() {
+		m.consumers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up waiting for in-flight messages: %v", ctx.Err())
+	}
+}
+
+func (m *InMemoryMessagingClient) init() {
+	if m.exchanges == nil {
+		m.exchanges = make(map[string]*memExchange)
+	}
+	if m.queues == nil {
+		m.queues = make(map[string]*memQueue)
+	}
+}
+
+// declareExchange returns the named exchange, creating it if needed. Like a real broker,
+// redeclaring an exchange with another type is an error. Callers must hold m.mu.
+func (m *InMemoryMessagingClient) declareExchange(name string, kind string) (*memExchange, error) {
+	m.init()
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return nil, fmt.Errorf("Exchange type %v is not supported by the in-memory broker", kind)
+	}
+	if ex, ok := m.exchanges[name]; ok {
+		if ex.kind != kind {
+			return nil, fmt.Errorf("Exchange %v already declared with type %v, not %v", name, ex.kind, kind)
+		}
+		return ex, nil
+	}
+	ex := &memExchange{name: name, kind: kind}
+	m.exchanges[name] = ex
+	return ex, nil
+}
+
+// declareQueue returns the named queue, creating it if needed. An empty name creates a new
+// server-named queue. Callers must hold m.mu.
+func (m *InMemoryMessagingClient) declareQueue(name string) *memQueue {
+	m.init()
+	if name == "" {
+		m.queueSeq++
+		name = fmt.Sprintf("amq.gen-%d", m.queueSeq)
+	}
+	if q, ok := m.queues[name]; ok {
+		return q
+	}
+	q := newMemQueue(name)
+	m.queues[name] = q
+	return q
+}
+
+// routes reports whether a message with routingKey should go to a queue bound with bindingKey.
+func (ex *memExchange) routes(bindingKey string, routingKey string) bool {
+	switch ex.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+// topicMatches implements AMQP topic matching, where '*' matches exactly one word and '#'
+// matches zero or more words.
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+// toDelivery turns an outgoing message into what a consumer would receive from a broker.
+func toDelivery(msg amqp.Publishing, exchangeName string, routingKey string) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Exchange:        exchangeName,
+		RoutingKey:      routingKey,
+		Body:            msg.Body,
+	}
+}
+
+func (q *memQueue) push(d amqp.Delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.deliveryTag++
+	d.DeliveryTag = q.deliveryTag
+	if d.Timestamp.IsZero() {
+		d.Timestamp = time.Now()
+	}
+	q.messages = append(q.messages, d)
+	q.cond.Signal()
+}
+
+// pop blocks until a message is available. It returns false once the queue has been closed.
+func (q *memQueue) pop() (amqp.Delivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.messages) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return amqp.Delivery{}, false
+	}
+	d := q.messages[0]
+	q.messages = q.messages[1:]
+	return d, true
+}
+
+func (q *memQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.messages = nil
+	q.cond.Broadcast()
+}
+
+func (q *memQueue) consume(consumerName string, handlerFunc func(amqp.Delivery)) {
+	for {
+		d, ok := q.pop()
+		if !ok {
+			return
+		}
+		d.ConsumerTag = consumerName
+		handlerFunc(d)
+	}
+}
@@ -0,0 +1,198 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func collect(ch chan amqp.Delivery) func(amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		ch <- d
+	}
+}
+
+func receive(ch chan amqp.Delivery) *amqp.Delivery {
+	select {
+	case d := <-ch:
+		return &d
+	case <-time.After(time.Millisecond * 500):
+		return nil
+	}
+}
+
+func TestInMemoryQueue(t *testing.T) {
+	Convey("Given an in-memory broker with a consumer on vipQueue", t, func() {
+		client := &InMemoryMessagingClient{}
+		client.ConnectToBroker(InMemoryBrokerURL)
+		defer client.Close()
+
+		received := make(chan amqp.Delivery, 10)
+		So(client.SubscribeToQueue("vipQueue", "vipservice", collect(received)), ShouldBeNil)
+
+		Convey("When a message is published on the queue", func() {
+			So(client.PublishOnQueue([]byte(`{"accountId":"10000"}`), "vipQueue"), ShouldBeNil)
+
+			Convey("Then the consumer gets it", func() {
+				d := receive(received)
+				So(d, ShouldNotBeNil)
+				So(string(d.Body), ShouldEqual, `{"accountId":"10000"}`)
+				So(d.ConsumerTag, ShouldEqual, "vipservice")
+			})
+		})
+	})
+
+	Convey("Given a message published before anyone consumes the queue", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+		So(client.PublishOnQueue([]byte("early"), "discovery"), ShouldBeNil)
+
+		Convey("When a consumer subscribes", func() {
+			received := make(chan amqp.Delivery, 10)
+			client.SubscribeToQueue("discovery", "test", collect(received))
+
+			Convey("Then the message is still delivered", func() {
+				d := receive(received)
+				So(d, ShouldNotBeNil)
+				So(string(d.Body), ShouldEqual, "early")
+			})
+		})
+	})
+
+	Convey("Given two consumers on the same queue", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+		received := make(chan amqp.Delivery, 10)
+		client.SubscribeToQueue("work", "first", collect(received))
+		client.SubscribeToQueue("work", "second", collect(received))
+
+		Convey("When two messages are published", func() {
+			client.PublishOnQueue([]byte("1"), "work")
+			client.PublishOnQueue([]byte("2"), "work")
+
+			Convey("Then each message is delivered exactly once", func() {
+				So(receive(received), ShouldNotBeNil)
+				So(receive(received), ShouldNotBeNil)
+				So(receive(received), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestInMemoryExchanges(t *testing.T) {
+	Convey("Given two subscribers on a topic exchange", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+		first := make(chan amqp.Delivery, 10)
+		second := make(chan amqp.Delivery, 10)
+		So(client.Subscribe("springCloudBus", "topic", "accountservice", collect(first)), ShouldBeNil)
+		So(client.Subscribe("springCloudBus", "topic", "vipservice", collect(second)), ShouldBeNil)
+
+		Convey("When a message is published on the exchange", func() {
+			So(client.Publish([]byte("refresh"), "springCloudBus", "topic"), ShouldBeNil)
+
+			Convey("Then both subscribers get a copy", func() {
+				So(receive(first), ShouldNotBeNil)
+				So(receive(second), ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the exchange is redeclared with another type", func() {
+			err := client.Publish([]byte("refresh"), "springCloudBus", "fanout")
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given an exchange no queue is bound to", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+
+		Convey("When a message is published with confirmation", func() {
+			err := client.PublishMessageConfirmed(amqp.Publishing{MessageId: "lost"}, "accountEvents", "topic")
+
+			Convey("Then it is returned as unroutable", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "returned")
+			})
+		})
+
+		Convey("When a message is published without confirmation", func() {
+			Convey("Then it is dropped like a broker would", func() {
+				So(client.PublishMessage(amqp.Publishing{}, "accountEvents", "topic"), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given a closed client", t, func() {
+		client := &InMemoryMessagingClient{}
+		client.Close()
+
+		Convey("Then publishing fails", func() {
+			So(client.PublishOnQueue([]byte("x"), "vipQueue"), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTopicMatches(t *testing.T) {
+	Convey("Given AMQP topic binding keys", t, func() {
+		matches := func(binding string, key string) bool {
+			ex := &memExchange{kind: amqp.ExchangeTopic}
+			return ex.routes(binding, key)
+		}
+
+		Convey("Then '*' matches exactly one word", func() {
+			So(matches("account.*", "account.created"), ShouldBeTrue)
+			So(matches("account.*", "account"), ShouldBeFalse)
+			So(matches("account.*", "account.created.v1"), ShouldBeFalse)
+		})
+
+		Convey("Then '#' matches zero or more words", func() {
+			So(matches("account.#", "account"), ShouldBeTrue)
+			So(matches("account.#", "account.created.v1"), ShouldBeTrue)
+			So(matches("#.v1", "account.created.v1"), ShouldBeTrue)
+			So(matches("#", "anything.at.all"), ShouldBeTrue)
+			So(matches("image.#", "account.created"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestInMemoryShutdown(t *testing.T) {
+	Convey("Given a consumer that is busy handling a message", t, func() {
+		client := &InMemoryMessagingClient{}
+		started := make(chan struct{})
+		finished := make(chan struct{}, 1)
+		client.SubscribeToQueue("slow", "test", func(d amqp.Delivery) {
+			close(started)
+			time.Sleep(time.Millisecond * 100)
+			finished <- struct{}{}
+		})
+		client.PublishOnQueue([]byte("x"), "slow")
+		<-started
+
+		Convey("When the client is shut down with enough time", func() {
+			err := client.Shutdown(context.Background())
+
+			Convey("Then it waits for the handler to finish", func() {
+				So(err, ShouldBeNil)
+				So(len(finished), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the client is shut down with a short deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+			defer cancel()
+			err := client.Shutdown(ctx)
+
+			Convey("Then it gives up and reports it", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -1,8 +1,12 @@
 package messaging
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -12,14 +16,34 @@ type IMessagingClient interface {
 	ConnectToBroker(connectionString string)
 	Publish(msg []byte, exchangeName string, exchangeType string) error
 	PublishOnQueue(msg []byte, queueName string) error
+	PublishMessage(msg amqp.Publishing, exchangeName string, exchangeType string) error
+	PublishMessageOnQueue(msg amqp.Publishing, queueName string) error
+	PublishMessageConfirmed(msg amqp.Publishing, exchangeName string, exchangeType string) error
 	Subscribe(exchangeName string, exchangeType string, consumerName string, handlerFunc func(amqp.Delivery)) error
 	SubscribeToQueue(queueName string, consumerName string, handlerFunc func(amqp.Delivery)) error
+	SubscribeToQueueAcked(queueName string, consumerName string, prefetch int, handlerFunc func(amqp.Delivery)) error
+	DeclareTopology(topology Topology) error
 	Close()
+	Shutdown(ctx context.Context) error
 }
 
+// How long PublishMessageConfirmed waits for the broker to confirm a message.
+var ConfirmTimeout = 5 * time.Second
+
 // Real implementation, encapsulates a pointer to an amqp.Connection
 type MessagingClient struct {
 	conn *amqp.Connection
+
+	mu        sync.Mutex
+	topology  Topology
+	declared  map[string]bool // Queues declareQueue has declared on this connection
+	consumers []consumer
+	loops     sync.WaitGroup // One per consumeLoop, done once its deliveries have all been handled
+}
+
+type consumer struct {
+	ch  *amqp.Channel
+	tag string
 }
 
 func (m *MessagingClient) ConnectToBroker(connectionString string) {
@@ -32,23 +56,23 @@ func (m *MessagingClient) ConnectToBroker(connectionString string) {
 	if err != nil {
 		panic("Failed to connect to AMQP compatible broker at: " + connectionString)
 	}
+	m.mu.Lock()
+	m.declared = make(map[string]bool)
+	m.mu.Unlock()
 }
 
 func (m *MessagingClient) Publish(body []byte, exchangeName string, exchangeType string) error {
+	return m.PublishMessage(amqp.Publishing{Body: body}, exchangeName, exchangeType)
+}
+
+// PublishMessage works like Publish but lets the caller set AMQP properties and headers.
+func (m *MessagingClient) PublishMessage(msg amqp.Publishing, exchangeName string, exchangeType string) error {
 	if m.conn == nil {
 		panic("Tried to send message before connection was initialized. Don't do that.")
 	}
 	ch, err := m.conn.Channel() // Get a channel from the connection
 	defer ch.Close()
-	err = ch.ExchangeDeclare(
-		exchangeName, // name of the exchange
-		exchangeType, // type
-		true,         // durable
-		false,        // delete when complete
-		false,        // internal
-		false,        // noWait
-		nil,          // arguments
-	)
+	err = m.declareExchange(ch, exchangeName, exchangeType)
 	failOnError(err, "Failed to register an Exchange")
 
 	queue, err := ch.QueueDeclare( // Declare a queue that will be created if not exists with some args
@@ -73,28 +97,89 @@ func (m *MessagingClient) Publish(body []byte, exchangeName string, exchangeType
 		exchangeName, // routing key      q.Name
 		false,        // mandatory
 		false,        // immediate
-		amqp.Publishing{
-			Body: body, // Our JSON body as []byte
-		})
-	log.Printf("A message was sent: %v", body)
+		msg)
+	log.Printf("A message was sent: %v", msg.Body)
 	return err
 }
 
+// PublishMessageConfirmed works like PublishMessage, but puts the channel in confirm mode and only
+// returns nil once the broker has taken responsibility for the message. The message is published
+// as mandatory, so one that no queue is bound to receive is returned by the broker and is an error
+// rather than silently dropped.
+func (m *MessagingClient) PublishMessageConfirmed(msg amqp.Publishing, exchangeName string, exchangeType string) error {
+	if m.conn == nil {
+		panic("Tried to send message before connection was initialized. Don't do that.")
+	}
+	ch, err := m.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Failed to open a channel: %v", err)
+	}
+	defer ch.Close()
+
+	err = m.declareExchange(ch, exchangeName, exchangeType)
+	if err != nil {
+		return fmt.Errorf("Failed to register an Exchange: %v", err)
+	}
+	if err = ch.Confirm(false); err != nil {
+		return fmt.Errorf("Failed to put channel in confirm mode: %v", err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	err = ch.Publish(
+		exchangeName, // exchange
+		exchangeName, // routing key
+		true,         // mandatory
+		false,        // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case confirmation, ok := <-confirms:
+		if !ok {
+			return fmt.Errorf("Channel closed before message %v was confirmed", msg.MessageId)
+		}
+		if !confirmation.Ack {
+			return fmt.Errorf("Broker rejected message %v", msg.MessageId)
+		}
+		// The broker sends basic.return before the ack of an unroutable message, and the channel
+		// delivers them in that order.
+		select {
+		case returned := <-returns:
+			return fmt.Errorf("Message %v to exchange %v was returned: %v %v", msg.MessageId, exchangeName, returned.ReplyCode, returned.ReplyText)
+		default:
+		}
+		log.Printf("A message was confirmed: %v", msg.MessageId)
+		return nil
+	case <-time.After(ConfirmTimeout):
+		return fmt.Errorf("Timed out waiting for broker to confirm message %v", msg.MessageId)
+	}
+}
+
 func (m *MessagingClient) PublishOnQueue(body []byte, queueName string) error {
+	return m.PublishMessageOnQueue(amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body, // Our JSON body as []byte
+	}, queueName)
+}
+
+// PublishMessageOnQueue works like PublishOnQueue but lets the caller set AMQP properties and headers.
+func (m *MessagingClient) PublishMessageOnQueue(msg amqp.Publishing, queueName string) error {
 	if m.conn == nil {
 		panic("Tried to send message before connection was initialized. Don't do that.")
 	}
 	ch, err := m.conn.Channel() // Get a channel from the connection
 	defer ch.Close()
 
-	queue, err := ch.QueueDeclare( // Declare a queue that will be created if not exists with some args
-		queueName, // our queue name
-		false,     // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
+	queue, err := m.declareQueue(ch, queueName)
+	if err != nil {
+		return fmt.Errorf("Failed to register a Queue: %v", err)
+	}
+	if msg.DeliveryMode == 0 && m.isDurableQueue(queueName) {
+		msg.DeliveryMode = amqp.Persistent // Otherwise the message is lost when the broker restarts
+	}
 
 	// Publishes a message onto the queue.
 	err = ch.Publish(
@@ -102,11 +187,8 @@ func (m *MessagingClient) PublishOnQueue(body []byte, queueName string) error {
 		queue.Name, // routing key
 		false,      // mandatory
 		false,      // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body, // Our JSON body as []byte
-		})
-	log.Printf("A message was sent to queue %v: %v", queueName, body)
+		msg)
+	log.Printf("A message was sent to queue %v: %v", queueName, msg.Body)
 	return err
 }
 
@@ -115,15 +197,7 @@ func (m *MessagingClient) Subscribe(exchangeName string, exchangeType string, co
 	failOnError(err, "Failed to open a channel")
 	// defer ch.Close()
 
-	err = ch.ExchangeDeclare(
-		exchangeName, // name of the exchange
-		exchangeType, // type
-		true,         // durable
-		false,        // delete when complete
-		false,        // internal
-		false,        // noWait
-		nil,          // arguments
-	)
+	err = m.declareExchange(ch, exchangeName, exchangeType)
 	failOnError(err, "Failed to register an Exchange")
 
 	log.Printf("declared Exchange, declaring Queue (%s)", "")
@@ -162,7 +236,7 @@ func (m *MessagingClient) Subscribe(exchangeName string, exchangeType string, co
 	)
 	failOnError(err, "Failed to register a consumer")
 
-	go consumeLoop(msgs, handlerFunc)
+	m.startConsumer(ch, consumerName, msgs, handlerFunc)
 	return nil
 }
 
@@ -171,14 +245,7 @@ func (m *MessagingClient) SubscribeToQueue(queueName string, consumerName string
 	failOnError(err, "Failed to open a channel")
 
 	log.Printf("Declaring Queue (%s)", queueName)
-	queue, err := ch.QueueDeclare(
-		queueName, // name of the queue
-		false,     // durable
-		false,     // delete when usused
-		false,     // exclusive
-		false,     // noWait
-		nil,       // arguments
-	)
+	queue, err := m.declareQueue(ch, queueName)
 	failOnError(err, "Failed to register an Queue")
 
 	msgs, err := ch.Consume(
@@ -192,7 +259,83 @@ func (m *MessagingClient) SubscribeToQueue(queueName string, consumerName string
 	)
 	failOnError(err, "Failed to register a consumer")
 
-	go consumeLoop(msgs, handlerFunc)
+	m.startConsumer(ch, consumerName, msgs, handlerFunc)
+	return nil
+}
+
+// SubscribeToQueueAcked works like SubscribeToQueue, except that the broker sends the consumer at
+// most prefetch deliveries it hasn't acknowledged yet, and keeps the rest queued. handlerFunc must
+// Ack or Nack every delivery. Deliveries that weren't acknowledged when the consumer goes away are
+// put back on the queue.
+func (m *MessagingClient) SubscribeToQueueAcked(queueName string, consumerName string, prefetch int, handlerFunc func(amqp.Delivery)) error {
+	ch, err := m.conn.Channel()
+	failOnError(err, "Failed to open a channel")
+
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("Failed to set prefetch of consumer %v: %v", consumerName, err)
+	}
+
+	log.Printf("Declaring Queue (%s)", queueName)
+	queue, err := m.declareQueue(ch, queueName)
+	failOnError(err, "Failed to register an Queue")
+
+	msgs, err := ch.Consume(
+		queue.Name,   // queue
+		consumerName, // consumer
+		false,        // auto-ack
+		false,        // exclusive
+		false,        // no-local
+		false,        // no-wait
+		nil,          // args
+	)
+	failOnError(err, "Failed to register a consumer")
+
+	m.startConsumer(ch, consumerName, msgs, handlerFunc)
+	return nil
+}
+
+// DeclareTopology declares the exchanges, queues and bindings of topology. Anything that already
+// exists on the broker must have been declared with the same settings, otherwise an error is
+// returned. Exchanges and queues declared later on by the other methods get their settings from
+// the topology. It may be called more than once; each call adds to what was declared before.
+func (m *MessagingClient) DeclareTopology(topology Topology) error {
+	if m.conn == nil {
+		panic("Tried to declare topology before connection was initialized. Don't do that.")
+	}
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+	ch, err := m.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Failed to open a channel: %v", err)
+	}
+	defer ch.Close()
+
+	// The broker closes the channel on the first mismatch, so we stop at the first error.
+	for _, ex := range topology.Exchanges {
+		err = ch.ExchangeDeclare(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, nil)
+		if err != nil {
+			return topologyError("Exchange", ex.Name, err)
+		}
+		log.Printf("Declared exchange %v (%v)", ex.Name, ex.Type)
+	}
+	for _, q := range topology.Queues {
+		queue, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments())
+		if err != nil {
+			return topologyError("Queue", q.Name, err)
+		}
+		log.Printf("Declared queue %v (%d messages, %d consumers)", queue.Name, queue.Messages, queue.Consumers)
+	}
+	for _, b := range topology.Bindings {
+		if err = ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("Failed to bind queue %v to exchange %v: %v", b.Queue, b.Exchange, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.topology = m.topology.merge(topology)
+	m.mu.Unlock()
 	return nil
 }
 
@@ -202,6 +345,138 @@ func (m *MessagingClient) Close() {
 	}
 }
 
+// Shutdown stops all consumers, waits for handlers that are already running (or have deliveries
+// buffered for them) to finish, and then closes the channels and connection. If ctx expires first,
+// the connection is closed anyway and an error is returned.
+func (m *MessagingClient) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	consumers := m.consumers
+	m.consumers = nil
+	m.mu.Unlock()
+
+	for _, c := range consumers {
+		if err := c.ch.Cancel(c.tag, false); err != nil {
+			log.Printf("Failed to cancel consumer %v: %v", c.tag, err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		m.loops.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		log.Println("All in-flight messages handled")
+	case <-ctx.Done():
+		err = fmt.Errorf("Gave up waiting for in-flight messages: %v", ctx.Err())
+	}
+
+	for _, c := range consumers {
+		c.ch.Close()
+	}
+	m.Close()
+	return err
+}
+
+func (m *MessagingClient) startConsumer(ch *amqp.Channel, tag string, deliveries <-chan amqp.Delivery, handlerFunc func(d amqp.Delivery)) {
+	m.mu.Lock()
+	m.consumers = append(m.consumers, consumer{ch: ch, tag: tag})
+	m.mu.Unlock()
+
+	m.loops.Add(1)
+	go func() {
+		defer m.loops.Done()
+		consumeLoop(deliveries, handlerFunc)
+	}()
+}
+
+// declareExchange declares an exchange with its settings from the topology, or as a durable
+// exchange of the given type if it isn't part of it.
+func (m *MessagingClient) declareExchange(ch *amqp.Channel, name string, kind string) error {
+	m.mu.Lock()
+	cfg, ok := m.topology.Exchange(name)
+	m.mu.Unlock()
+	if !ok {
+		cfg = ExchangeConfig{Name: name, Type: kind, Durable: true}
+	} else if cfg.Type != kind {
+		return fmt.Errorf("Exchange %v is configured as %v, not %v", name, cfg.Type, kind)
+	}
+	return ch.ExchangeDeclare(
+		cfg.Name,       // name of the exchange
+		cfg.Type,       // type
+		cfg.Durable,    // durable
+		cfg.AutoDelete, // delete when complete
+		cfg.Internal,   // internal
+		false,          // noWait
+		nil,            // arguments
+	)
+}
+
+// declareQueue declares a named queue with its settings from the topology. A queue that isn't part
+// of it is used as it is if it already exists, and is created durable otherwise. Each queue is only
+// declared once per connection, so publishing to it doesn't cost extra round-trips every time.
+func (m *MessagingClient) declareQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	m.mu.Lock()
+	cfg, ok := m.topology.Queue(name)
+	declared := m.declared[name]
+	m.mu.Unlock()
+	if declared {
+		return amqp.Queue{Name: name}, nil
+	}
+	if !ok {
+		// A failed passive declare closes the channel, so it gets one of its own.
+		probe, err := m.conn.Channel()
+		if err != nil {
+			return amqp.Queue{}, err
+		}
+		defer probe.Close()
+		if queue, err := probe.QueueDeclarePassive(name, false, false, false, false, nil); err == nil {
+			m.markDeclared(name)
+			return queue, nil
+		}
+		cfg = QueueConfig{Name: name, Durable: true}
+	}
+	queue, err := ch.QueueDeclare(
+		cfg.Name,        // name of the queue
+		cfg.Durable,     // durable
+		cfg.AutoDelete,  // delete when unused
+		cfg.Exclusive,   // exclusive
+		false,           // noWait
+		cfg.Arguments(), // arguments
+	)
+	if err == nil {
+		m.markDeclared(name)
+	}
+	return queue, err
+}
+
+func (m *MessagingClient) markDeclared(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.declared == nil {
+		m.declared = make(map[string]bool)
+	}
+	m.declared[name] = true
+}
+
+// isDurableQueue reports whether messages for the queue should be published as persistent.
+func (m *MessagingClient) isDurableQueue(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg, ok := m.topology.Queue(name)
+	return !ok || cfg.Durable
+}
+
+func topologyError(kind string, name string, err error) error {
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("%v %v already exists on the broker with other settings than configured: %v", kind, name, amqpErr.Reason)
+	}
+	return fmt.Errorf("Failed to declare %v %v: %v", strings.ToLower(kind), name, err)
+}
+
 func consumeLoop(deliveries <-chan amqp.Delivery, handlerFunc func(d amqp.Delivery)) {
 	for d := range deliveries {
 		// Invoke the handlerFunc func we passed as parameter.
@@ -2,6 +2,7 @@
 
 package messaging
 
+import context "context"
 import amqp "github.com/streadway/amqp"
 
 import mock "github.com/stretchr/testify/mock"
@@ -21,6 +22,20 @@ func (_m *MockMessagingClient) ConnectToBroker(connectionString string) {
 	_m.Called(connectionString)
 }
 
+// DeclareTopology provides a mock function with given fields: topology
+func (_m *MockMessagingClient) DeclareTopology(topology Topology) error {
+	ret := _m.Called(topology)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(Topology) error); ok {
+		r0 = rf(topology)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Publish provides a mock function with given fields: msg, exchangeName, exchangeType
 func (_m *MockMessagingClient) Publish(msg []byte, exchangeName string, exchangeType string) error {
 	ret := _m.Called(msg, exchangeName, exchangeType)
@@ -49,6 +64,62 @@ func (_m *MockMessagingClient) PublishOnQueue(msg []byte, queueName string) erro
 	return r0
 }
 
+// PublishMessage provides a mock function with given fields: msg, exchangeName, exchangeType
+func (_m *MockMessagingClient) PublishMessage(msg amqp.Publishing, exchangeName string, exchangeType string) error {
+	ret := _m.Called(msg, exchangeName, exchangeType)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(amqp.Publishing, string, string) error); ok {
+		r0 = rf(msg, exchangeName, exchangeType)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PublishMessageConfirmed provides a mock function with given fields: msg, exchangeName, exchangeType
+func (_m *MockMessagingClient) PublishMessageConfirmed(msg amqp.Publishing, exchangeName string, exchangeType string) error {
+	ret := _m.Called(msg, exchangeName, exchangeType)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(amqp.Publishing, string, string) error); ok {
+		r0 = rf(msg, exchangeName, exchangeType)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PublishMessageOnQueue provides a mock function with given fields: msg, queueName
+func (_m *MockMessagingClient) PublishMessageOnQueue(msg amqp.Publishing, queueName string) error {
+	ret := _m.Called(msg, queueName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(amqp.Publishing, string) error); ok {
+		r0 = rf(msg, queueName)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Shutdown provides a mock function with given fields: ctx
+func (_m *MockMessagingClient) Shutdown(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Subscribe provides a mock function with given fields: exchangeName, exchangeType, consumerName, handlerFunc
 func (_m *MockMessagingClient) Subscribe(exchangeName string, exchangeType string, consumerName string, handlerFunc func(amqp.Delivery)) error {
 	ret := _m.Called(exchangeName, exchangeType, consumerName, handlerFunc)
@@ -76,3 +147,17 @@ func (_m *MockMessagingClient) SubscribeToQueue(queueName string, consumerName s
 
 	return r0
 }
+
+// SubscribeToQueueAcked provides a mock function with given fields: queueName, consumerName, prefetch, handlerFunc
+func (_m *MockMessagingClient) SubscribeToQueueAcked(queueName string, consumerName string, prefetch int, handlerFunc func(amqp.Delivery)) error {
+	ret := _m.Called(queueName, consumerName, prefetch, handlerFunc)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, int, func(amqp.Delivery)) error); ok {
+		r0 = rf(queueName, consumerName, prefetch, handlerFunc)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
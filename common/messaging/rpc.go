@@ -0,0 +1,228 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	rpcErrorHeader    = "x-rpc-error"
+	rpcDeadlineHeader = "x-rpc-deadline"
+)
+
+// DefaultRPCTimeout applies to calls whose context has no deadline.
+var DefaultRPCTimeout = 5 * time.Second
+
+// RPCHandlerFunc handles a single request and returns the reply payload. Returning an error sends
+// the error message back to the caller instead.
+type RPCHandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// RPCError is returned by Call when the remote handler failed.
+type RPCError struct {
+	RoutingKey string
+	Message    string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC call to %v failed: %v", e.RoutingKey, e.Message)
+}
+
+// RPCClient performs request/reply calls over the broker. Replies arrive on a private reply queue
+// and are matched to their callers by correlation ID.
+type RPCClient struct {
+	client     IMessagingClient
+	replyQueue string
+
+	mu      sync.Mutex
+	pending map[string]chan amqp.Delivery
+}
+
+// NewRPCClient starts consuming from a new reply queue for consumerName.
+func NewRPCClient(client IMessagingClient, consumerName string) (*RPCClient, error) {
+	c := &RPCClient{
+		client:     client,
+		replyQueue: "rpc.reply." + consumerName + "." + NewMessageID(),
+		pending:    make(map[string]chan amqp.Delivery),
+	}
+	// The reply queue is only of use to this process. Being exclusive, the broker deletes it when
+	// the connection closes, even if the process dies before it starts consuming.
+	err := client.DeclareTopology(Topology{Queues: map[string]QueueConfig{
+		c.replyQueue: {Name: c.replyQueue, AutoDelete: true, Exclusive: true},
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to declare RPC reply queue %v: %v", c.replyQueue, err)
+	}
+	err = client.SubscribeToQueue(c.replyQueue, consumerName, c.onReply)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to consume RPC replies on %v: %v", c.replyQueue, err)
+	}
+	return c, nil
+}
+
+// Call sends payload to the handler registered for routingKey and waits for its reply, or until ctx
+// is done. Calls without a deadline time out after DefaultRPCTimeout. Requests that are still
+// queued when the caller gives up expire on the broker instead of being processed.
+func (c *RPCClient) Call(ctx context.Context, routingKey string, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRPCTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	ttl := int64(time.Until(deadline) / time.Millisecond)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	correlationID := NewMessageID()
+	reply := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	c.pending[correlationID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, correlationID)
+		c.mu.Unlock()
+	}()
+
+	span := tracing.StartProducerSpanFromContext(ctx, "rpc "+routingKey, routingKey)
+	if span != nil {
+		defer span.Finish()
+		ctx = tracing.UpdateContext(ctx, span)
+	}
+
+	msg := amqp.Publishing{
+		Headers:       amqp.Table{rpcDeadlineHeader: deadline.UnixNano() / int64(time.Millisecond)},
+		CorrelationId: correlationID,
+		ReplyTo:       c.replyQueue,
+		Expiration:    strconv.FormatInt(ttl, 10),
+		MessageId:     NewMessageID(),
+		Timestamp:     time.Now().UTC(),
+		AppId:         Producer,
+		Body:          payload,
+	}
+	tracing.AddTracingToPublishingFromContext(ctx, &msg)
+	if err := c.client.PublishMessageOnQueue(msg, routingKey); err != nil {
+		return nil, fmt.Errorf("Unable to send RPC request to %v: %v", routingKey, err)
+	}
+
+	select {
+	case d := <-reply:
+		if errMsg, ok := d.Headers[rpcErrorHeader].(string); ok {
+			if span != nil {
+				ext.Error.Set(span, true)
+			}
+			return nil, &RPCError{RoutingKey: routingKey, Message: errMsg}
+		}
+		return d.Body, nil
+	case <-ctx.Done():
+		if span != nil {
+			ext.Error.Set(span, true)
+		}
+		return nil, fmt.Errorf("RPC call to %v gave up waiting for a reply: %v", routingKey, ctx.Err())
+	}
+}
+
+func (c *RPCClient) onReply(d amqp.Delivery) {
+	c.mu.Lock()
+	reply, ok := c.pending[d.CorrelationId]
+	c.mu.Unlock()
+	if !ok {
+		logrus.Warnf("Dropping RPC reply %v, nobody is waiting for it", d.CorrelationId)
+		return
+	}
+	// A duplicate or redelivered reply mustn't hold up the replies to other calls.
+	select {
+	case reply <- d:
+	default:
+		logrus.Warnf("Dropping duplicate RPC reply %v", d.CorrelationId)
+	}
+}
+
+// ServeRPC registers handler for requests sent to routingKey. At most concurrency requests are
+// handled at a time; while all workers are busy, further requests stay queued on the broker.
+// Requests whose caller has already given up are skipped.
+//
+// Each worker is a separate consumer with a prefetch of one, handling its requests inline, so a
+// client Shutdown waits for requests that are being handled. A request is only acknowledged once
+// its reply has been sent, so requests of a server that crashes are handled by another one.
+func ServeRPC(client IMessagingClient, routingKey string, consumerName string, concurrency int, handler RPCHandlerFunc) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		err := client.SubscribeToQueueAcked(routingKey, fmt.Sprintf("%v-%d", consumerName, i), 1, func(d amqp.Delivery) {
+			serveRPCRequest(client, routingKey, d, handler)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveRPCRequest(client IMessagingClient, routingKey string, d amqp.Delivery, handler RPCHandlerFunc) {
+	if d.ReplyTo == "" {
+		logrus.Errorf("Dropping RPC request %v to %v without a reply-to queue", d.CorrelationId, routingKey)
+		ackRPCRequest(d, routingKey)
+		return
+	}
+
+	span := tracing.StartAMQPTrace(d, "rpc "+routingKey)
+	defer span.Finish()
+	ctx := tracing.UpdateContext(context.Background(), span)
+	if deadline, err := headerInt(d.Headers, rpcDeadlineHeader); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, int64(deadline)*int64(time.Millisecond)))
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		logrus.Warnf("Skipping RPC request %v to %v, the caller has given up", d.CorrelationId, routingKey)
+		ackRPCRequest(d, routingKey)
+		return
+	}
+
+	reply := amqp.Publishing{
+		CorrelationId: d.CorrelationId,
+		Timestamp:     time.Now().UTC(),
+		AppId:         Producer,
+	}
+	body, err := handler(ctx, d.Body)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", err.Error())
+		reply.Headers = amqp.Table{rpcErrorHeader: err.Error()}
+	} else {
+		reply.Body = body
+	}
+	if err := client.PublishMessageOnQueue(reply, d.ReplyTo); err != nil {
+		// Put back, to be handled again unless the caller gives up first and the request expires.
+		logrus.Errorf("Unable to reply to RPC request %v to %v: %v", d.CorrelationId, routingKey, err)
+		if d.Acknowledger == nil {
+			return
+		}
+		if err := d.Nack(false, true); err != nil {
+			logrus.Errorf("Unable to requeue RPC request %v to %v: %v", d.CorrelationId, routingKey, err)
+		}
+		return
+	}
+	ackRPCRequest(d, routingKey)
+}
+
+// ackRPCRequest acknowledges that a request is done with. In-memory deliveries need no acknowledging.
+func ackRPCRequest(d amqp.Delivery, routingKey string) {
+	if d.Acknowledger == nil {
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		logrus.Errorf("Unable to acknowledge RPC request %v to %v: %v", d.CorrelationId, routingKey, err)
+	}
+}
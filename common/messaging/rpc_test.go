@@ -0,0 +1,186 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/mock"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRPC(t *testing.T) {
+	Convey("Given an RPC server and client on an in-memory broker", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+
+		err := ServeRPC(client, "test.upper", "server", 2, func(ctx context.Context, payload []byte) ([]byte, error) {
+			switch string(payload) {
+			case "fail":
+				return nil, fmt.Errorf("cannot handle %v", string(payload))
+			case "slow":
+				time.Sleep(time.Millisecond * 200)
+			}
+			return []byte(strings.ToUpper(string(payload))), nil
+		})
+		So(err, ShouldBeNil)
+
+		rpc, err := NewRPCClient(client, "caller")
+		So(err, ShouldBeNil)
+
+		Convey("When a call is made", func() {
+			reply, err := rpc.Call(context.Background(), "test.upper", []byte("hello"))
+
+			Convey("Then the handler's reply is returned", func() {
+				So(err, ShouldBeNil)
+				So(string(reply), ShouldEqual, "HELLO")
+			})
+		})
+
+		Convey("When several calls are made concurrently", func() {
+			replies := make(chan string, 5)
+			for i := 0; i < 5; i++ {
+				go func(i int) {
+					reply, _ := rpc.Call(context.Background(), "test.upper", []byte(fmt.Sprintf("call%d", i)))
+					replies <- string(reply)
+				}(i)
+			}
+
+			Convey("Then every caller gets its own reply", func() {
+				got := map[string]bool{}
+				for i := 0; i < 5; i++ {
+					got[<-replies] = true
+				}
+				for i := 0; i < 5; i++ {
+					So(got[fmt.Sprintf("CALL%d", i)], ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("When a reply arrives twice", func() {
+			rpc.mu.Lock()
+			rpc.pending["duplicated"] = make(chan amqp.Delivery, 1)
+			rpc.mu.Unlock()
+			done := make(chan struct{})
+			go func() {
+				rpc.onReply(amqp.Delivery{CorrelationId: "duplicated"})
+				rpc.onReply(amqp.Delivery{CorrelationId: "duplicated"})
+				close(done)
+			}()
+
+			Convey("Then the duplicate is dropped without holding up other replies", func() {
+				select {
+				case <-done:
+				case <-time.After(time.Millisecond * 500):
+					t.Fatal("onReply blocked on a duplicate reply")
+				}
+				reply, err := rpc.Call(context.Background(), "test.upper", []byte("after"))
+				So(err, ShouldBeNil)
+				So(string(reply), ShouldEqual, "AFTER")
+			})
+		})
+
+		Convey("When the handler fails", func() {
+			_, err := rpc.Call(context.Background(), "test.upper", []byte("fail"))
+
+			Convey("Then the remote error is returned", func() {
+				So(err, ShouldHaveSameTypeAs, &RPCError{})
+				So(err.Error(), ShouldContainSubstring, "cannot handle fail")
+			})
+		})
+
+		Convey("When the handler is slower than the caller's deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			_, err := rpc.Call(ctx, "test.upper", []byte("slow"))
+
+			Convey("Then the call times out", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "deadline exceeded")
+			})
+		})
+	})
+}
+
+func TestRPCReplyQueue(t *testing.T) {
+	Convey("Given a broker", t, func() {
+		client := &MockMessagingClient{}
+		client.On("DeclareTopology", mock.Anything).Return(nil)
+		client.On("SubscribeToQueue", mock.Anything, "caller", mock.Anything).Return(nil)
+
+		Convey("When an RPC client is created", func() {
+			rpc, err := NewRPCClient(client, "caller")
+			So(err, ShouldBeNil)
+
+			Convey("Then its reply queue is deleted by the broker once the connection is gone", func() {
+				topology := client.Calls[0].Arguments.Get(0).(Topology)
+				queue, ok := topology.Queue(rpc.replyQueue)
+				So(ok, ShouldBeTrue)
+				So(queue.Durable, ShouldBeFalse)
+				So(queue.Exclusive, ShouldBeTrue)
+				So(queue.AutoDelete, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+// acknowledger records what is done with a delivery.
+type acknowledger struct {
+	events []string
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.events = append(a.events, "ack")
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.events = append(a.events, fmt.Sprintf("nack requeue=%v", requeue))
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.events = append(a.events, fmt.Sprintf("reject requeue=%v", requeue))
+	return nil
+}
+
+func TestServeRPCAcknowledgesAfterReplying(t *testing.T) {
+	Convey("Given an RPC server on a broker", t, func() {
+		ack := &acknowledger{}
+		var handle func(amqp.Delivery)
+		broker := &MockMessagingClient{}
+		broker.On("SubscribeToQueueAcked", "test.upper", "server-0", 1, mock.Anything).
+			Run(func(args mock.Arguments) {
+				handle = args.Get(3).(func(amqp.Delivery))
+			}).Return(nil)
+
+		err := ServeRPC(broker, "test.upper", "server", 1, func(ctx context.Context, payload []byte) ([]byte, error) {
+			return []byte(strings.ToUpper(string(payload))), nil
+		})
+		So(err, ShouldBeNil)
+		request := amqp.Delivery{Acknowledger: ack, ReplyTo: "rpc.reply.caller", CorrelationId: "1", Body: []byte("hello")}
+
+		Convey("When the reply is sent", func() {
+			broker.On("PublishMessageOnQueue", mock.Anything, "rpc.reply.caller").
+				Run(func(args mock.Arguments) { ack.events = append(ack.events, "reply") }).Return(nil)
+			handle(request)
+
+			Convey("Then the request is acknowledged after it", func() {
+				So(ack.events, ShouldResemble, []string{"reply", "ack"})
+			})
+		})
+
+		Convey("When the reply can't be sent", func() {
+			broker.On("PublishMessageOnQueue", mock.Anything, "rpc.reply.caller").Return(fmt.Errorf("channel closed"))
+			handle(request)
+
+			Convey("Then the request is put back on the queue", func() {
+				So(ack.events, ShouldResemble, []string{"nack requeue=true"})
+			})
+		})
+	})
+}
@@ -0,0 +1,183 @@
+package messaging
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// TopologyConfigKey is the Viper key the broker topology of a service is read from. Entries are
+// keyed by an identifier of our choosing, since Viper lower-cases keys; the actual broker name
+// goes in the name property. For example:
+//
+//	amqp_topology.exchanges.accountevents.name: accountEvents
+//	amqp_topology.exchanges.accountevents.type: topic
+//	amqp_topology.queues.vip.name: vipQueue
+//	amqp_topology.queues.vip.messageTtl: 86400000
+//	amqp_topology.queues.vip.maxLength: 10000
+//	amqp_topology.queues.vip.deadLetterExchange: vipQueue.dlx
+//
+// Exchanges and queues are durable unless durable is set to false.
+const TopologyConfigKey = "amqp_topology"
+
+// Topology describes the exchanges, queues and bindings a service expects on the broker.
+type Topology struct {
+	Exchanges map[string]ExchangeConfig
+	Queues    map[string]QueueConfig
+	Bindings  map[string]BindingConfig
+}
+
+type ExchangeConfig struct {
+	Name       string
+	Type       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+}
+
+type QueueConfig struct {
+	Name                 string
+	Durable              bool
+	AutoDelete           bool
+	Exclusive            bool // Only used by this connection, and deleted when it closes
+	MessageTTL           int  // milliseconds, 0 means messages don't expire
+	MaxLength            int  // 0 means unbounded
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+}
+
+type BindingConfig struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+}
+
+// LoadTopology reads the topology under TopologyConfigKey. Since config.Load sets every key on its
+// own, a service's default topology can be refined key by key from the config server.
+func LoadTopology() (Topology, error) {
+	topology := Topology{}
+	if !viper.IsSet(TopologyConfigKey) {
+		return topology, nil
+	}
+	if err := viper.UnmarshalKey(TopologyConfigKey, &topology); err != nil {
+		return topology, fmt.Errorf("Invalid %v configuration: %v", TopologyConfigKey, err)
+	}
+
+	for id, ex := range topology.Exchanges {
+		if ex.Name == "" {
+			ex.Name = id
+		}
+		if !viper.IsSet(TopologyConfigKey + ".exchanges." + id + ".durable") {
+			ex.Durable = true
+		}
+		topology.Exchanges[id] = ex
+	}
+	for id, q := range topology.Queues {
+		if q.Name == "" {
+			q.Name = id
+		}
+		if !viper.IsSet(TopologyConfigKey + ".queues." + id + ".durable") {
+			q.Durable = true
+		}
+		topology.Queues[id] = q
+	}
+	return topology, topology.Validate()
+}
+
+// Validate checks that the topology is consistent in itself. Whether it matches what already
+// exists on the broker is checked by DeclareTopology.
+func (t Topology) Validate() error {
+	for id, ex := range t.Exchanges {
+		switch ex.Type {
+		case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		default:
+			return fmt.Errorf("Exchange %v has unknown type '%v'", id, ex.Type)
+		}
+	}
+	for id, q := range t.Queues {
+		if q.MessageTTL < 0 || q.MaxLength < 0 {
+			return fmt.Errorf("Queue %v has a negative messageTtl or maxLength", id)
+		}
+		if q.DeadLetterExchange != "" && !t.hasExchange(q.DeadLetterExchange) {
+			return fmt.Errorf("Queue %v dead-letters to exchange %v, which is not part of the topology", id, q.DeadLetterExchange)
+		}
+	}
+	for id, b := range t.Bindings {
+		if !t.hasExchange(b.Exchange) {
+			return fmt.Errorf("Binding %v refers to exchange %v, which is not part of the topology", id, b.Exchange)
+		}
+		if _, ok := t.Queue(b.Queue); !ok {
+			return fmt.Errorf("Binding %v refers to queue %v, which is not part of the topology", id, b.Queue)
+		}
+	}
+	return nil
+}
+
+// Exchange returns the configuration for the exchange with the given broker name.
+func (t Topology) Exchange(name string) (ExchangeConfig, bool) {
+	for _, ex := range t.Exchanges {
+		if ex.Name == name {
+			return ex, true
+		}
+	}
+	return ExchangeConfig{}, false
+}
+
+// Queue returns the configuration for the queue with the given broker name.
+func (t Topology) Queue(name string) (QueueConfig, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return QueueConfig{}, false
+}
+
+// merge returns a topology with the entries of both, where other wins when an identifier is used
+// in both.
+func (t Topology) merge(other Topology) Topology {
+	merged := Topology{
+		Exchanges: make(map[string]ExchangeConfig),
+		Queues:    make(map[string]QueueConfig),
+		Bindings:  make(map[string]BindingConfig),
+	}
+	for _, source := range []Topology{t, other} {
+		for id, ex := range source.Exchanges {
+			merged.Exchanges[id] = ex
+		}
+		for id, q := range source.Queues {
+			merged.Queues[id] = q
+		}
+		for id, b := range source.Bindings {
+			merged.Bindings[id] = b
+		}
+	}
+	return merged
+}
+
+func (t Topology) hasExchange(name string) bool {
+	_, ok := t.Exchange(name)
+	return ok
+}
+
+// Arguments returns the x-arguments to declare the queue with.
+func (q QueueConfig) Arguments() amqp.Table {
+	args := amqp.Table{}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = int32(q.MessageTTL)
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = int32(q.MaxLength)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
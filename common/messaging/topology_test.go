@@ -0,0 +1,112 @@
+package messaging
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadTopology(t *testing.T) {
+	Convey("Given a topology in the configuration", t, func() {
+		viper.Reset()
+		defer viper.Reset()
+		viper.Set("amqp_topology.exchanges.dlx.name", "vipQueue.dlx")
+		viper.Set("amqp_topology.exchanges.dlx.type", "fanout")
+		viper.Set("amqp_topology.queues.vip.name", "vipQueue")
+		viper.Set("amqp_topology.queues.vip.messageTtl", float64(60000)) // Numbers from the config server are float64
+		viper.Set("amqp_topology.queues.vip.maxLength", "1000")
+		viper.Set("amqp_topology.queues.vip.deadLetterExchange", "vipQueue.dlx")
+		viper.Set("amqp_topology.queues.dead.name", "vipQueue.dead")
+		viper.Set("amqp_topology.queues.dead.durable", false)
+		viper.Set("amqp_topology.bindings.dead.queue", "vipQueue.dead")
+		viper.Set("amqp_topology.bindings.dead.exchange", "vipQueue.dlx")
+
+		Convey("When it is loaded", func() {
+			topology, err := LoadTopology()
+
+			Convey("Then names keep their case and durable defaults to true", func() {
+				So(err, ShouldBeNil)
+				vip, ok := topology.Queue("vipQueue")
+				So(ok, ShouldBeTrue)
+				So(vip.Durable, ShouldBeTrue)
+				dead, _ := topology.Queue("vipQueue.dead")
+				So(dead.Durable, ShouldBeFalse)
+				dlx, _ := topology.Exchange("vipQueue.dlx")
+				So(dlx.Durable, ShouldBeTrue)
+			})
+
+			Convey("Then the queue arguments are set", func() {
+				vip, _ := topology.Queue("vipQueue")
+				So(vip.Arguments(), ShouldResemble, amqp.Table{
+					"x-message-ttl":          int32(60000),
+					"x-max-length":           int32(1000),
+					"x-dead-letter-exchange": "vipQueue.dlx",
+				})
+			})
+		})
+
+		Convey("When a queue dead-letters to an exchange that isn't declared", func() {
+			viper.Set("amqp_topology.queues.vip.deadLetterExchange", "nowhere")
+			_, err := LoadTopology()
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given no topology in the configuration", t, func() {
+		viper.Reset()
+
+		Convey("Then an empty topology is loaded", func() {
+			topology, err := LoadTopology()
+			So(err, ShouldBeNil)
+			So(len(topology.Queues), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestInMemoryDeclareTopology(t *testing.T) {
+	Convey("Given an in-memory broker with a declared topology", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+		err := client.DeclareTopology(Topology{
+			Exchanges: map[string]ExchangeConfig{"events": {Name: "accountEvents", Type: "topic", Durable: true}},
+			Queues: map[string]QueueConfig{
+				"audit": {Name: "audit", Durable: true},
+				"other": {Name: "other", Durable: true},
+			},
+			Bindings: map[string]BindingConfig{
+				"audit": {Queue: "audit", Exchange: "accountEvents", RoutingKey: "#"},
+				"other": {Queue: "other", Exchange: "accountEvents", RoutingKey: "image.#"},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("When a message is published before anyone consumes the bound queues", func() {
+			So(client.Publish([]byte("created"), "accountEvents", "topic"), ShouldBeNil)
+
+			Convey("Then only the queue with a matching binding holds it", func() {
+				audit := make(chan amqp.Delivery, 10)
+				other := make(chan amqp.Delivery, 10)
+				client.SubscribeToQueue("audit", "test", collect(audit))
+				client.SubscribeToQueue("other", "test", collect(other))
+				So(receive(audit), ShouldNotBeNil)
+				So(receive(other), ShouldBeNil)
+			})
+		})
+
+		Convey("When an exchange is redeclared with another type", func() {
+			err := client.DeclareTopology(Topology{
+				Exchanges: map[string]ExchangeConfig{"events": {Name: "accountEvents", Type: "fanout"}},
+			})
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,181 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// TypedHandlerFunc receives a decoded typed message. payload is a pointer to a new value of the
+// Go type registered for the message's type and version.
+type TypedHandlerFunc func(ctx context.Context, envelope Envelope, payload interface{})
+
+type messageType struct {
+	name    string
+	version int
+}
+
+var registry = struct {
+	sync.RWMutex
+	byGoType map[reflect.Type]messageType
+	byName   map[messageType]reflect.Type
+}{
+	byGoType: make(map[reflect.Type]messageType),
+	byName:   make(map[messageType]reflect.Type),
+}
+
+// RegisterMessageType binds a message type name and schema version to the Go type of prototype.
+// Publishing a value of that Go type stamps it with name and version, and consuming a message
+// with that name and version decodes it into a new value of the Go type. Register each schema
+// version a service should accept; the most recently registered one is used when publishing.
+func RegisterMessageType(name string, version int, prototype interface{}) {
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	mt := messageType{name: name, version: version}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, ok := registry.byName[mt]; ok && existing != t {
+		panic(fmt.Sprintf("Message type %v version %v is already registered to %v", name, version, existing))
+	}
+	registry.byName[mt] = t
+	registry.byGoType[t] = mt
+}
+
+func lookupGoType(name string, version int) (reflect.Type, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.byName[messageType{name: name, version: version}]
+	return t, ok
+}
+
+func lookupMessageType(payload interface{}) (messageType, bool) {
+	t := reflect.TypeOf(payload)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	mt, ok := registry.byGoType[t]
+	return mt, ok
+}
+
+// NewEnvelope marshals payload into a new Envelope. The payload's Go type must be registered.
+func NewEnvelope(ctx context.Context, payload interface{}) (Envelope, error) {
+	mt, ok := lookupMessageType(payload)
+	if !ok {
+		return Envelope{}, fmt.Errorf("No message type registered for %T", payload)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("Unable to marshal %v: %v", mt.name, err)
+	}
+	return Envelope{
+		Type:          mt.name,
+		Version:       mt.version,
+		MessageID:     NewMessageID(),
+		CorrelationID: CorrelationIDFromContext(ctx),
+		Producer:      Producer,
+		Timestamp:     time.Now().UTC(),
+		ContentType:   "application/json",
+		Body:          body,
+	}, nil
+}
+
+// PublishTyped publishes payload as a typed message on an exchange. If ctx carries a span, the
+// publish is traced and the span context travels along in the message headers.
+func PublishTyped(ctx context.Context, client IMessagingClient, payload interface{}, exchangeName string, exchangeType string) error {
+	return publishTyped(ctx, payload, exchangeName, func(msg amqp.Publishing) error {
+		return client.PublishMessage(msg, exchangeName, exchangeType)
+	})
+}
+
+// PublishTypedOnQueue publishes payload as a typed message on a named queue. If ctx carries a span,
+// the publish is traced and the span context travels along in the message headers.
+func PublishTypedOnQueue(ctx context.Context, client IMessagingClient, payload interface{}, queueName string) error {
+	return publishTyped(ctx, payload, queueName, func(msg amqp.Publishing) error {
+		return client.PublishMessageOnQueue(msg, queueName)
+	})
+}
+
+func publishTyped(ctx context.Context, payload interface{}, destination string, publish func(amqp.Publishing) error) error {
+	envelope, err := NewEnvelope(ctx, payload)
+	if err != nil {
+		return err
+	}
+	span := tracing.StartProducerSpanFromContext(ctx, "publish "+envelope.Type, destination)
+	if span != nil {
+		defer span.Finish()
+		ctx = tracing.UpdateContext(ctx, span)
+	}
+	msg := envelope.Publishing()
+	tracing.AddTracingToPublishingFromContext(ctx, &msg)
+	err = publish(msg)
+	if err != nil && span != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", err.Error())
+	}
+	return err
+}
+
+// SubscribeTypedToQueue consumes typed messages from a named queue.
+func SubscribeTypedToQueue(client IMessagingClient, queueName string, consumerName string, handler TypedHandlerFunc) error {
+	return client.SubscribeToQueue(queueName, consumerName, TypedHandler(handler))
+}
+
+// TypedHandler adapts a TypedHandlerFunc to the plain delivery handlers used by IMessagingClient.
+// Messages with a missing, unknown or unsupported type/version, or a body that doesn't decode,
+// are logged and dropped. Each message is handled within a consumer span that continues the
+// publisher's trace; the span is available from the handler's ctx.
+func TypedHandler(handler TypedHandlerFunc) func(amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		span := tracing.StartAMQPTrace(d, "consume "+d.Type)
+		defer span.Finish()
+
+		envelope, payload, err := decodeTyped(d)
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("event", "error", "message", err.Error())
+			logrus.Errorf("Rejecting message from %v: %v", d.AppId, err)
+			return
+		}
+		ctx := WithCorrelationID(context.Background(), envelope.CorrelationID)
+		handler(tracing.UpdateContext(ctx, span), envelope, payload)
+	}
+}
+
+// TracedHandler wraps a plain delivery handler in a consumer span that continues the publisher's
+// trace. The span is available from the handler's ctx.
+func TracedHandler(opName string, handler func(ctx context.Context, d amqp.Delivery)) func(amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		span := tracing.StartAMQPTrace(d, opName)
+		defer span.Finish()
+		handler(tracing.UpdateContext(context.Background(), span), d)
+	}
+}
+
+func decodeTyped(d amqp.Delivery) (Envelope, interface{}, error) {
+	envelope, err := EnvelopeFromDelivery(d)
+	if err != nil {
+		return envelope, nil, err
+	}
+	t, ok := lookupGoType(envelope.Type, envelope.Version)
+	if !ok {
+		return envelope, nil, fmt.Errorf("Unknown message type %v version %v", envelope.Type, envelope.Version)
+	}
+	payload := reflect.New(t).Interface()
+	if err := json.Unmarshal(envelope.Body, payload); err != nil {
+		return envelope, nil, fmt.Errorf("Unable to decode %v version %v: %v", envelope.Type, envelope.Version, err)
+	}
+	return envelope, payload, nil
+}
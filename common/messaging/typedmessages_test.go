@@ -0,0 +1,155 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/streadway/amqp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testNotification struct {
+	AccountId string `json:"accountId"`
+}
+
+type testNotificationV2 struct {
+	AccountId string `json:"accountId"`
+	Level     string `json:"level"`
+}
+
+func init() {
+	tracing.SetTracer(opentracing.NoopTracer{})
+	RegisterMessageType("TestNotification", 1, testNotification{})
+}
+
+func TestTypedMessages(t *testing.T) {
+	Convey("Given a typed consumer on an in-memory queue", t, func() {
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+
+		type received struct {
+			envelope Envelope
+			payload  interface{}
+		}
+		got := make(chan received, 10)
+		SubscribeTypedToQueue(client, "typed", "test", func(ctx context.Context, envelope Envelope, payload interface{}) {
+			got <- received{envelope, payload}
+		})
+
+		Convey("When a registered payload is published", func() {
+			ctx := WithCorrelationID(context.Background(), "corr-1")
+			err := PublishTypedOnQueue(ctx, client, testNotification{AccountId: "10000"}, "typed")
+			So(err, ShouldBeNil)
+
+			Convey("Then it is decoded into the registered type with its metadata", func() {
+				var r received
+				select {
+				case r = <-got:
+				case <-time.After(time.Second):
+				}
+				So(r.payload, ShouldResemble, &testNotification{AccountId: "10000"})
+				So(r.envelope.Type, ShouldEqual, "TestNotification")
+				So(r.envelope.Version, ShouldEqual, 1)
+				So(r.envelope.CorrelationID, ShouldEqual, "corr-1")
+				So(r.envelope.Producer, ShouldEqual, Producer)
+				So(r.envelope.MessageID, ShouldNotBeEmpty)
+				So(r.envelope.ContentType, ShouldEqual, "application/json")
+			})
+		})
+
+		Convey("When a message with an unknown schema version arrives", func() {
+			envelope := Envelope{Type: "TestNotification", Version: 2, Body: []byte(`{"accountId":"1"}`)}
+			client.PublishMessageOnQueue(envelope.Publishing(), "typed")
+
+			Convey("Then it is rejected", func() {
+				select {
+				case <-got:
+					t.Fail()
+				case <-time.After(time.Millisecond * 200):
+				}
+			})
+		})
+
+		Convey("When a bare JSON message arrives", func() {
+			client.PublishOnQueue([]byte(`{"accountId":"1"}`), "typed")
+
+			Convey("Then it is rejected", func() {
+				select {
+				case <-got:
+					t.Fail()
+				case <-time.After(time.Millisecond * 200):
+				}
+			})
+		})
+	})
+
+	Convey("Given a payload type that isn't registered", t, func() {
+		_, err := NewEnvelope(context.Background(), testNotificationV2{})
+
+		Convey("Then no envelope can be created", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given an envelope", t, func() {
+		envelope := Envelope{Type: "TestNotification", Version: 3, MessageID: "id", Producer: "accountservice"}
+
+		Convey("Then it survives a round trip through AMQP properties", func() {
+			p := envelope.Publishing()
+			d := amqp.Delivery{Type: p.Type, Headers: p.Headers, MessageId: p.MessageId, AppId: p.AppId}
+			decoded, err := EnvelopeFromDelivery(d)
+			So(err, ShouldBeNil)
+			So(decoded.Version, ShouldEqual, 3)
+			So(decoded.Producer, ShouldEqual, "accountservice")
+		})
+	})
+}
+
+func TestTypedMessagesPropagateTraces(t *testing.T) {
+	Convey("Given a typed consumer and a tracer", t, func() {
+		tracer := mocktracer.New()
+		tracing.SetTracer(tracer)
+		defer tracing.SetTracer(opentracing.NoopTracer{})
+
+		client := &InMemoryMessagingClient{}
+		defer client.Close()
+		done := make(chan struct{}, 1)
+		SubscribeTypedToQueue(client, "traced", "test", func(ctx context.Context, envelope Envelope, payload interface{}) {
+			done <- struct{}{}
+		})
+
+		Convey("When a message is published within a span", func() {
+			parent := tracer.StartSpan("GetAccount")
+			ctx := tracing.UpdateContext(context.Background(), parent)
+			So(PublishTypedOnQueue(ctx, client, testNotification{AccountId: "10000"}, "traced"), ShouldBeNil)
+			parent.Finish()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+			}
+			time.Sleep(time.Millisecond * 10) // Let the consumer span finish
+
+			Convey("Then the consumer span continues the same trace", func() {
+				spans := tracer.FinishedSpans()
+				So(len(spans), ShouldEqual, 3)
+				byName := map[string]*mocktracer.MockSpan{}
+				for _, span := range spans {
+					byName[span.OperationName] = span
+				}
+				root := byName["GetAccount"]
+				publish := byName["publish TestNotification"]
+				consume := byName["consume TestNotification"]
+				So(publish, ShouldNotBeNil)
+				So(consume, ShouldNotBeNil)
+				So(publish.ParentID, ShouldEqual, root.SpanContext.SpanID)
+				So(consume.ParentID, ShouldEqual, publish.SpanContext.SpanID)
+				So(consume.SpanContext.TraceID, ShouldEqual, root.SpanContext.TraceID)
+			})
+		})
+	})
+}
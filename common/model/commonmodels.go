@@ -7,6 +7,15 @@ type AccountEvent struct {
 	Created   string `json:"created"`
 }
 
+// AccountChanged is published on the accountEvents exchange whenever an account is stored. Unlike
+// AccountEvent, it carries the ID of the account.
+type AccountChanged struct {
+	EventID   string `json:"eventId"`
+	AccountID string `json:"accountId"`
+	EventName string `json:"eventName"`
+	Created   string `json:"created"`
+}
+
 type AccountImage struct {
 	ID       string `json:"id" gorm:"primary_key"`
 	URL      string `json:"url"`
@@ -18,3 +27,8 @@ type AccountData struct {
 	Name   string         `json:"name"`
 	Events []AccountEvent `json:"events" gorm:"ForeignKey:AccountID"`
 }
+
+type VipNotification struct {
+	AccountId string `json:"accountId"`
+	ReadAt    string `json:"readAt"`
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/streadway/amqp"
+)
+
+// amqpHeadersCarrier lets the tracer read and write span contexts as AMQP message headers.
+type amqpHeadersCarrier amqp.Table
+
+func (c amqpHeadersCarrier) Set(key, val string) {
+	c[key] = val
+}
+
+func (c amqpHeadersCarrier) ForeachKey(handler func(key, val string) error) error {
+	for k, v := range c {
+		if s, ok := v.(string); ok {
+			if err := handler(k, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SpanFromContext returns the span stored in ctx by UpdateContext, or nil.
+func SpanFromContext(ctx context.Context) opentracing.Span {
+	if span, ok := ctx.Value("opentracing-span").(opentracing.Span); ok {
+		return span
+	}
+	return nil
+}
+
+// StartProducerSpanFromContext starts a child span for publishing a message, if ctx carries a span.
+// It returns nil otherwise, so that background publishing doesn't create new root traces.
+func StartProducerSpanFromContext(ctx context.Context, opName string, destination string) opentracing.Span {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	child := tracer.StartSpan(opName, opentracing.ChildOf(parent.Context()), ext.SpanKindProducer)
+	ext.MessageBusDestination.Set(child, destination)
+	return child
+}
+
+// AddTracingToPublishingFromContext injects the span within ctx, if any, into the headers of an
+// OUTGOING AMQP message.
+func AddTracingToPublishingFromContext(ctx context.Context, msg *amqp.Publishing) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	err := injectSpanContext(span.Context(), amqpHeadersCarrier(msg.Headers))
+	if err != nil {
+		reportPropagationFailure(err)
+	}
+}
+
+// StartAMQPTrace loads tracing information from an INCOMING AMQP message and starts a consumer span,
+// as a child of the publisher's span when the message carries one.
+func StartAMQPTrace(d amqp.Delivery, opName string) opentracing.Span {
+	if tracer == nil {
+		// Consumers in services that don't report traces, like imageservice, get a span that goes nowhere.
+		return opentracing.NoopTracer{}.StartSpan(opName)
+	}
+	clientContext, err := extractSpanContext(amqpHeadersCarrier(d.Headers))
+	if err == nil {
+		return tracer.StartSpan(opName, opentracing.ChildOf(clientContext), ext.SpanKindConsumer)
+	}
+	return startRootSpan(opName, "", ext.SpanKindConsumer)
+}
@@ -0,0 +1,24 @@
+package tracing
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStartAMQPTraceWithoutTracer(t *testing.T) {
+	Convey("Given a service that hasn't initialized tracing", t, func() {
+		SetTracer(nil)
+
+		Convey("When a message is consumed", func() {
+			span := StartAMQPTrace(amqp.Delivery{Headers: amqp.Table{}}, "consume test")
+
+			Convey("Then it still gets a span", func() {
+				So(span, ShouldNotBeNil)
+				So(func() { span.Finish() }, ShouldNotPanic)
+			})
+		})
+	})
+}
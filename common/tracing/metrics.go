@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"expvar"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tracing failures never fail requests, they are counted instead. The counters are published with
+// expvar, which services serve on /debug/vars of their HTTP port.
+var (
+	exportFailures      = expvar.NewInt("tracing_export_failures")
+	propagationFailures = expvar.NewInt("tracing_propagation_failures")
+)
+
+// Only every logEvery-th failure of a kind is logged, so a Zipkin that is down doesn't flood the log.
+const logEvery = 100
+
+// reportExportFailure counts spans or batches of spans that couldn't be sent.
+func reportExportFailure(err error) {
+	exportFailures.Add(1)
+	if n := exportFailures.Value(); n%logEvery == 1 {
+		logrus.Warnf("Couldn't export spans (%d failures so far): %v", n, err)
+	}
+}
+
+// reportPropagationFailure counts trace contexts that couldn't be added to outgoing requests or
+// messages.
+func reportPropagationFailure(err error) {
+	propagationFailures.Add(1)
+	if n := propagationFailures.Value(); n%logEvery == 1 {
+		logrus.Warnf("Couldn't propagate trace context (%d failures so far): %v", n, err)
+	}
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Tag for the number of bytes in the response body.
+const httpResponseSize = "http.response_size"
+
+// HTTPMiddleware traces every request a router handles. Use it with router.Use, so that spans are
+// named after the route template, e.g. "GET /accounts/{accountId}". The span is tagged with the
+// method, URL, status code, peer address and response size, marked as an error for 5xx responses,
+// and put in the request context for handlers to start child spans from. Panics are recorded on
+// the span before they are passed on.
+func HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := StartHTTPTrace(r, operationName(r))
+		ext.SpanKindRPCServer.Set(span)
+		ext.HTTPMethod.Set(span, r.Method)
+		ext.HTTPUrl.Set(span, r.URL.String())
+		ext.PeerAddress.Set(span, r.RemoteAddr)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				ext.HTTPStatusCode.Set(span, http.StatusInternalServerError)
+				ext.Error.Set(span, true)
+				span.LogFields(
+					log.String("event", "error"),
+					log.String("error.kind", "panic"),
+					log.String("message", fmt.Sprint(p)),
+					log.String("stack", string(debug.Stack())))
+				span.Finish()
+				panic(p)
+			}
+			ext.HTTPStatusCode.Set(span, uint16(rec.status))
+			span.SetTag(httpResponseSize, rec.size)
+			if rec.status >= 500 {
+				ext.Error.Set(span, true)
+			}
+			span.Finish()
+		}()
+		next.ServeHTTP(rec, r.WithContext(UpdateContext(r.Context(), span)))
+	})
+}
+
+// operationName is the method and route template of the request, or its path if the router didn't
+// match a route.
+func operationName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
+
+// responseRecorder remembers the status code and counts the bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers take over the connection, e.g. for websockets.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", r.ResponseWriter)
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	Convey("Given a traced router", t, func() {
+		mock := mocktracer.New()
+		SetTracer(mock)
+		defer SetTracer(opentracing.NoopTracer{})
+
+		router := mux.NewRouter()
+		router.Methods("GET").Path("/accounts/{accountId}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if SpanFromContext(r.Context()) == nil {
+				http.Error(w, "no span", http.StatusTeapot)
+				return
+			}
+			w.Write([]byte(`{"id":"10000"}`))
+		})
+		router.Methods("GET").Path("/broken").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		router.Methods("GET").Path("/panic").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+		router.Use(HTTPMiddleware)
+
+		serve := func(path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			req.RemoteAddr = "10.0.0.7:51234"
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			return resp
+		}
+
+		Convey("When a request succeeds", func() {
+			resp := serve("/accounts/10000")
+
+			Convey("Then the span is named after the route and describes the request", func() {
+				So(resp.Code, ShouldEqual, 200)
+				spans := mock.FinishedSpans()
+				So(len(spans), ShouldEqual, 1)
+				So(spans[0].OperationName, ShouldEqual, "GET /accounts/{accountId}")
+				So(spans[0].Tag("http.method"), ShouldEqual, "GET")
+				So(spans[0].Tag("http.url"), ShouldEqual, "/accounts/10000")
+				So(spans[0].Tag("http.status_code"), ShouldEqual, uint16(200))
+				So(spans[0].Tag("peer.address"), ShouldEqual, "10.0.0.7:51234")
+				So(spans[0].Tag(httpResponseSize), ShouldEqual, len(`{"id":"10000"}`))
+				So(spans[0].Tag("error"), ShouldBeNil)
+			})
+		})
+
+		Convey("When a request fails with a 5xx", func() {
+			serve("/broken")
+
+			Convey("Then the span is marked as an error", func() {
+				spans := mock.FinishedSpans()
+				So(spans[0].Tag("http.status_code"), ShouldEqual, uint16(502))
+				So(spans[0].Tag("error"), ShouldEqual, true)
+			})
+		})
+
+		Convey("When a handler panics", func() {
+			So(func() { serve("/panic") }, ShouldPanicWith, "boom")
+
+			Convey("Then the panic is recorded on the span", func() {
+				spans := mock.FinishedSpans()
+				So(len(spans), ShouldEqual, 1)
+				So(spans[0].Tag("error"), ShouldEqual, true)
+				So(spans[0].Logs()[0].Fields[2].ValueString, ShouldEqual, "boom")
+			})
+		})
+	})
+}
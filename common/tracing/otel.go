@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	otelzipkin "go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The exporters Init can send spans to.
+const (
+	// ExporterZipkinLegacy is the zipkin-go-opentracing HTTP collector InitTracing uses.
+	ExporterZipkinLegacy = "zipkin"
+	// ExporterZipkin sends spans through OpenTelemetry to the Zipkin v2 API at the endpoint.
+	ExporterZipkin = "otel-zipkin"
+	// ExporterOTLP sends spans with OTLP/HTTP to a collector, e.g. http://otel-collector:4318.
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes spans to stdout as JSON, for local debugging.
+	ExporterStdout = "stdout"
+	// ExporterFile appends spans as JSON to the file at the endpoint.
+	ExporterFile = "file"
+)
+
+// Options describes the tracing pipeline of a service.
+type Options struct {
+	ServiceName string
+	// Exporter is one of the Exporter constants, ExporterZipkinLegacy if empty.
+	Exporter string
+	// Endpoint is the Zipkin or OTLP base URL, or the path of the file for ExporterFile.
+	Endpoint string
+}
+
+// Init sets up tracing for a service. Apart from ExporterZipkinLegacy, spans are recorded by the
+// OpenTelemetry SDK behind an OpenTracing bridge, so the helpers in this package work the same
+// whichever exporter is used. The returned func flushes buffered spans and should be called when
+// the service stops. If the exporter can't be created, the error is returned and logged, and the
+// service carries on with a no-op tracer.
+func Init(opts Options) (func(ctx context.Context) error, error) {
+	noop := func(ctx context.Context) error { return nil }
+	if opts.Exporter == "" || opts.Exporter == ExporterZipkinLegacy {
+		return noop, InitTracing(opts.Endpoint, opts.ServiceName)
+	}
+
+	exporter, closeExporter, err := newExporter(opts)
+	if err != nil {
+		logrus.Errorf("Couldn't create %v trace exporter, tracing is disabled. Error: %v", opts.Exporter, err)
+		return noop, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(prioritySampler{})),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", opts.ServiceName))),
+	)
+	bridge, wrapperProvider := otelbridge.NewTracerPair(provider.Tracer("github.com/linhnh123/golang-microservices-tutorial/common/tracing"))
+	// The propagation formats are translated from B3, see injectSpanContext.
+	bridge.SetTextMapPropagator(b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+	bridge.SetWarningHandler(func(msg string) {
+		logrus.Debugf("OpenTracing bridge: %v", msg)
+	})
+	otel.SetTracerProvider(wrapperProvider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(reportExportFailure))
+	SetTracer(bridge)
+	logrus.Infof("Started OpenTelemetry tracing for service '%v', exporting to %v %v", opts.ServiceName, opts.Exporter, opts.Endpoint)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		closeExporter()
+		return err
+	}, nil
+}
+
+// newExporter returns the exporter for opts, and a func that releases what it holds on to.
+func newExporter(opts Options) (sdktrace.SpanExporter, func(), error) {
+	noop := func() {}
+	switch opts.Exporter {
+	case ExporterZipkin:
+		exporter, err := otelzipkin.New(strings.TrimSuffix(opts.Endpoint, "/") + "/api/v2/spans")
+		return exporter, noop, err
+	case ExporterOTLP:
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil || u.Host == "" {
+			return nil, nil, fmt.Errorf("Invalid OTLP endpoint '%v'", opts.Endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+		return exporter, noop, err
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, noop, err
+	case ExporterFile:
+		file, err := os.OpenFile(opts.Endpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Couldn't open trace file: %v", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return exporter, func() { file.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown trace exporter '%v'", opts.Exporter)
+	}
+}
+
+// prioritySampler samples new traces as startRootSpan decided. Spans started by OpenTelemetry
+// instrumentation rather than this package are sampled like traces that don't start with a request.
+type prioritySampler struct{}
+
+func (prioritySampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	sampled := false
+	decided := false
+	for _, attr := range p.Attributes {
+		if attr.Key == attribute.Key(ext.SamplingPriority) {
+			sampled, decided = cast.ToInt(attr.Value.AsInterface()) > 0, true
+		}
+	}
+	if !decided {
+		sampled = shouldSample("")
+	}
+	result := sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState()}
+	if sampled {
+		result.Decision = sdktrace.RecordAndSample
+	}
+	return result
+}
+
+func (prioritySampler) Description() string {
+	return "PrioritySampler"
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInit(t *testing.T) {
+	Convey("Given OpenTelemetry exporters", t, func() {
+		defer SetTracer(opentracing.NoopTracer{})
+
+		Convey("When spans are exported to a file", func() {
+			dir, _ := ioutil.TempDir("", "traces")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "traces.json")
+			shutdown, err := Init(Options{ServiceName: "accountservice", Exporter: ExporterFile, Endpoint: file})
+
+			Convey("Then the file is created and the pipeline stops cleanly", func() {
+				So(err, ShouldBeNil)
+				StartChildSpanFromContext(context.Background(), "GetAccount").Finish()
+				So(shutdown(context.Background()), ShouldBeNil)
+				_, err := os.Stat(file)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the OTLP endpoint is not a URL", func() {
+			_, err := Init(Options{ServiceName: "accountservice", Exporter: ExporterOTLP, Endpoint: "otel-collector"})
+
+			Convey("Then Init fails", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the exporter is unknown", func() {
+			_, err := Init(Options{ServiceName: "accountservice", Exporter: "jaeger"})
+
+			Convey("Then Init fails", func() {
+				So(err.Error(), ShouldContainSubstring, "Unknown trace exporter 'jaeger'")
+			})
+		})
+	})
+}
@@ -0,0 +1,282 @@
+package tracing
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Format is a way of passing the trace context between services in headers.
+type Format string
+
+const (
+	// FormatB3Multi uses the X-B3-TraceId, X-B3-SpanId, X-B3-ParentSpanId, X-B3-Sampled and X-B3-Flags
+	// headers. This is what the services have always used, and the default.
+	FormatB3Multi Format = "b3multi"
+	// FormatB3Single packs the same values into a single b3 header.
+	FormatB3Single Format = "b3"
+	// FormatW3C uses the traceparent and tracestate headers of W3C Trace Context.
+	FormatW3C Format = "tracecontext"
+)
+
+// PropagationConfigKey holds a comma separated list of formats, e.g. "tracecontext,b3multi".
+const PropagationConfigKey = "trace_propagation"
+
+var allFormats = []Format{FormatW3C, FormatB3Single, FormatB3Multi}
+
+var (
+	propagationLock sync.RWMutex
+	propagation     = []Format{FormatB3Multi}
+)
+
+// SetPropagation chooses the formats the trace context is passed on in. Outgoing requests and
+// messages carry all of them. Incoming ones are read in the first of them they carry, or else in
+// any other format, so services still join traces started by callers that are configured
+// differently.
+func SetPropagation(formats ...Format) error {
+	if len(formats) == 0 {
+		return fmt.Errorf("No trace propagation format given")
+	}
+	for _, f := range formats {
+		if !f.valid() {
+			return fmt.Errorf("Unknown trace propagation format '%v', use one of %v", f, allFormats)
+		}
+	}
+	propagationLock.Lock()
+	propagation = formats
+	propagationLock.Unlock()
+	return nil
+}
+
+// ParseFormats turns a list of format names, as found in configuration, into formats.
+func ParseFormats(names []string) []Format {
+	formats := make([]Format, 0, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(strings.ToLower(name)); name != "" {
+			formats = append(formats, Format(name))
+		}
+	}
+	return formats
+}
+
+func (f Format) valid() bool {
+	for _, known := range allFormats {
+		if f == known {
+			return true
+		}
+	}
+	return false
+}
+
+func propagationFormats() []Format {
+	propagationLock.RLock()
+	defer propagationLock.RUnlock()
+	return propagation
+}
+
+// injectSpanContext writes sc into carrier in every configured format.
+func injectSpanContext(sc opentracing.SpanContext, carrier opentracing.TextMapWriter) error {
+	// The tracer itself speaks B3, which the other formats are translated from.
+	b3 := textMap{}
+	if err := tracer.Inject(sc, opentracing.TextMap, b3); err != nil {
+		return err
+	}
+	if b3[b3TraceID] == "" {
+		// A tracer with a format of its own, like the mock tracer, gets to use it.
+		for key, val := range b3 {
+			carrier.Set(key, val)
+		}
+		return nil
+	}
+	for _, f := range propagationFormats() {
+		f.inject(b3, carrier)
+	}
+	return nil
+}
+
+// extractSpanContext reads the span context from carrier, see SetPropagation.
+func extractSpanContext(carrier opentracing.TextMapReader) (opentracing.SpanContext, error) {
+	headers := textMap{}
+	if err := carrier.ForeachKey(func(key, val string) error {
+		headers[strings.ToLower(key)] = val
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	formats := append(append([]Format{}, propagationFormats()...), allFormats...)
+	for _, f := range formats {
+		if b3, ok := f.extract(headers); ok {
+			return tracer.Extract(opentracing.TextMap, b3)
+		}
+	}
+	return tracer.Extract(opentracing.TextMap, headers)
+}
+
+// textMap is a carrier with lower-case keys.
+type textMap map[string]string
+
+func (m textMap) Set(key, val string) {
+	m[strings.ToLower(key)] = val
+}
+
+func (m textMap) ForeachKey(handler func(key, val string) error) error {
+	for k, v := range m {
+		if err := handler(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	b3TraceID      = "x-b3-traceid"
+	b3SpanID       = "x-b3-spanid"
+	b3ParentSpanID = "x-b3-parentspanid"
+	b3Sampled      = "x-b3-sampled"
+	b3Flags        = "x-b3-flags"
+	b3Single       = "b3"
+	baggagePrefix  = "ot-baggage-"
+	traceparent    = "traceparent"
+	tracestate     = "tracestate"
+
+	// tracestate is kept as baggage, so it follows the trace through the tracer to child spans.
+	tracestateBaggage = baggagePrefix + "w3c-tracestate"
+)
+
+// inject translates the B3 headers written by the tracer into format f.
+func (f Format) inject(b3 textMap, carrier opentracing.TextMapWriter) {
+	debug := b3[b3Flags] == "1"
+	sampled := b3[b3Sampled] == "1" || b3[b3Sampled] == "true" || debug
+	switch f {
+	case FormatB3Multi:
+		for _, key := range []string{b3TraceID, b3SpanID, b3ParentSpanID, b3Sampled, b3Flags} {
+			if b3[key] != "" {
+				carrier.Set(key, b3[key])
+			}
+		}
+	case FormatB3Single:
+		value := b3[b3TraceID] + "-" + b3[b3SpanID]
+		if debug {
+			value += "-d"
+		} else if sampled {
+			value += "-1"
+		} else {
+			value += "-0"
+		}
+		if b3[b3ParentSpanID] != "" {
+			value += "-" + b3[b3ParentSpanID]
+		}
+		carrier.Set(b3Single, value)
+	case FormatW3C:
+		flags := "00"
+		if sampled {
+			flags = "01"
+		}
+		carrier.Set(traceparent, "00-"+padTraceID(b3[b3TraceID])+"-"+b3[b3SpanID]+"-"+flags)
+		if b3[tracestateBaggage] != "" {
+			carrier.Set(tracestate, b3[tracestateBaggage])
+		}
+	}
+	for key, val := range b3 {
+		if strings.HasPrefix(key, baggagePrefix) && key != tracestateBaggage {
+			carrier.Set(key, val)
+		}
+	}
+}
+
+// extract translates headers in format f into the B3 headers the tracer reads. It returns false
+// if the headers don't carry a valid trace context in format f.
+func (f Format) extract(headers textMap) (textMap, bool) {
+	b3 := textMap{}
+	switch f {
+	case FormatB3Multi:
+		if !isHexID(headers[b3TraceID], 16, 32) || !isHexID(headers[b3SpanID], 16, 16) {
+			return nil, false
+		}
+		for _, key := range []string{b3TraceID, b3SpanID, b3ParentSpanID, b3Sampled, b3Flags} {
+			if headers[key] != "" {
+				b3[key] = headers[key]
+			}
+		}
+	case FormatB3Single:
+		// {traceid}-{spanid}[-{sampled}[-{parentspanid}]]. A lone sampling decision carries no context.
+		parts := strings.Split(headers[b3Single], "-")
+		if len(parts) < 2 || len(parts) > 4 || !isHexID(parts[0], 16, 32) || !isHexID(parts[1], 16, 16) {
+			return nil, false
+		}
+		b3[b3TraceID], b3[b3SpanID] = parts[0], parts[1]
+		if len(parts) > 2 {
+			switch parts[2] {
+			case "1", "0":
+				b3[b3Sampled] = parts[2]
+			case "d":
+				b3[b3Sampled], b3[b3Flags] = "1", "1"
+			default:
+				return nil, false
+			}
+		}
+		if len(parts) > 3 {
+			if !isHexID(parts[3], 16, 16) {
+				return nil, false
+			}
+			b3[b3ParentSpanID] = parts[3]
+		}
+	case FormatW3C:
+		// {version}-{trace-id}-{parent-id}-{trace-flags}, later versions may add fields.
+		parts := strings.Split(headers[traceparent], "-")
+		if len(parts) < 4 || !isHexID(parts[0], 2, 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+			!isHexID(parts[1], 32, 32) || !isHexID(parts[2], 16, 16) || !isHexID(parts[3], 2, 2) {
+			return nil, false
+		}
+		b3[b3TraceID], b3[b3SpanID] = parts[1], parts[2]
+		if flags := parts[3]; (fromHex(flags[1]) & 1) == 1 {
+			b3[b3Sampled] = "1"
+		} else {
+			b3[b3Sampled] = "0"
+		}
+		if headers[tracestate] != "" {
+			b3[tracestateBaggage] = headers[tracestate]
+		}
+	default:
+		return nil, false
+	}
+	for key, val := range headers {
+		if strings.HasPrefix(key, baggagePrefix) && key != tracestateBaggage {
+			b3[key] = val
+		}
+	}
+	return b3, true
+}
+
+// isHexID reports whether id is lower-case hex of between min and max characters, and not all zeros.
+func isHexID(id string, min int, max int) bool {
+	if len(id) < min || len(id) > max {
+		return false
+	}
+	zero := true
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+		zero = zero && c == '0'
+	}
+	return !zero || min == 2 // Version and flags may be 00
+}
+
+func fromHex(c byte) byte {
+	if c >= 'a' {
+		return c - 'a' + 10
+	}
+	return c - '0'
+}
+
+// padTraceID turns a 64 bit B3 trace id into the 128 bit one W3C requires.
+func padTraceID(id string) string {
+	if len(id) < 32 {
+		return strings.Repeat("0", 32-len(id)) + id
+	}
+	return id
+}
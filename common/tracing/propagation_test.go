@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// What the tracer writes for a sampled child span.
+var tracerB3 = textMap{
+	b3TraceID:         "463ac35c9f6413ad",
+	b3SpanID:          "a2fb4a1d1a96d312",
+	b3ParentSpanID:    "0020000000000001",
+	b3Sampled:         "1",
+	b3Flags:           "0",
+	"ot-baggage-user": "tester",
+}
+
+func TestInjectFormats(t *testing.T) {
+	Convey("Given the B3 headers written by the tracer", t, func() {
+		Convey("Then B3 multi-header passes them on", func() {
+			headers := textMap{}
+			FormatB3Multi.inject(tracerB3, headers)
+			So(headers, ShouldResemble, tracerB3)
+		})
+
+		Convey("Then B3 single-header packs them into one header", func() {
+			headers := textMap{}
+			FormatB3Single.inject(tracerB3, headers)
+			So(headers[b3Single], ShouldEqual, "463ac35c9f6413ad-a2fb4a1d1a96d312-1-0020000000000001")
+			So(headers[b3TraceID], ShouldBeEmpty)
+		})
+
+		Convey("Then W3C Trace Context gets a 128 bit trace id", func() {
+			headers := textMap{}
+			FormatW3C.inject(tracerB3, headers)
+			So(headers[traceparent], ShouldEqual, "00-0000000000000000463ac35c9f6413ad-a2fb4a1d1a96d312-01")
+			So(headers[tracestate], ShouldBeEmpty)
+			So(headers["ot-baggage-user"], ShouldEqual, "tester")
+		})
+	})
+}
+
+func TestExtractFormats(t *testing.T) {
+	Convey("Given a W3C traceparent and tracestate", t, func() {
+		headers := textMap{
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			tracestate:  "congo=t61rcWkgMzE",
+		}
+
+		Convey("Then they are read as B3, and tracestate is passed on to the next service", func() {
+			b3, ok := FormatW3C.extract(headers)
+			So(ok, ShouldBeTrue)
+			So(b3[b3TraceID], ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(b3[b3SpanID], ShouldEqual, "00f067aa0ba902b7")
+			So(b3[b3Sampled], ShouldEqual, "1")
+
+			out := textMap{}
+			FormatW3C.inject(b3, out)
+			So(out[traceparent], ShouldEqual, headers[traceparent])
+			So(out[tracestate], ShouldEqual, "congo=t61rcWkgMzE")
+		})
+
+		Convey("Then they are not mistaken for B3", func() {
+			_, ok := FormatB3Multi.extract(headers)
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given invalid traceparents", t, func() {
+		for _, value := range []string{
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		} {
+			_, ok := FormatW3C.extract(textMap{traceparent: value})
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("Given a traceparent of a later version", t, func() {
+		b3, ok := FormatW3C.extract(textMap{traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"})
+
+		Convey("Then the fields it shares with version 00 are read", func() {
+			So(ok, ShouldBeTrue)
+			So(b3[b3Sampled], ShouldEqual, "0")
+		})
+	})
+
+	Convey("Given a B3 single header with the debug flag", t, func() {
+		b3, ok := FormatB3Single.extract(textMap{b3Single: "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-d-05e3ac9a4f6e3b90"})
+
+		Convey("Then it is read as sampled and debug", func() {
+			So(ok, ShouldBeTrue)
+			So(b3[b3TraceID], ShouldEqual, "80f198ee56343ba864fe8b2a57d3eff7")
+			So(b3[b3ParentSpanID], ShouldEqual, "05e3ac9a4f6e3b90")
+			So(b3[b3Sampled], ShouldEqual, "1")
+			So(b3[b3Flags], ShouldEqual, "1")
+		})
+	})
+
+	Convey("Given a B3 single header with only a sampling decision", t, func() {
+		_, ok := FormatB3Single.extract(textMap{b3Single: "0"})
+
+		Convey("Then there is no context to join", func() {
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestSetPropagation(t *testing.T) {
+	Convey("Given formats from configuration", t, func() {
+		defer SetPropagation(FormatB3Multi)
+
+		Convey("Then known formats are accepted", func() {
+			So(SetPropagation(ParseFormats([]string{"TraceContext", " b3"})...), ShouldBeNil)
+			So(propagationFormats(), ShouldResemble, []Format{FormatW3C, FormatB3Single})
+		})
+
+		Convey("Then unknown formats are refused, keeping the current ones", func() {
+			So(SetPropagation(ParseFormats([]string{"tracecontext", "jaeger"})...), ShouldNotBeNil)
+			So(SetPropagation(), ShouldNotBeNil)
+			So(propagationFormats(), ShouldResemble, []Format{FormatB3Multi})
+		})
+	})
+}
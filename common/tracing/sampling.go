@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// Sampler decides whether a new trace is recorded. It is only asked for traces that start in this
+// service; traces that come in with a request or message keep the caller's decision.
+type Sampler interface {
+	Sample() bool
+}
+
+// ParseSampler reads a sampler from configuration: "always", "never", "probabilistic:0.1" to
+// record a tenth of the traces, or "ratelimited:5" to record at most five traces per second.
+func ParseSampler(spec string) (Sampler, error) {
+	name, arg := strings.TrimSpace(strings.ToLower(spec)), ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, arg = name[:i], name[i+1:]
+	}
+	switch name {
+	case "always", "never":
+		if arg != "" {
+			return nil, fmt.Errorf("Sampler '%v' takes no argument", spec)
+		}
+		return constSampler(name == "always"), nil
+	case "probabilistic":
+		p, err := strconv.ParseFloat(arg, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("Sampler '%v' needs a probability between 0 and 1", spec)
+		}
+		return probabilisticSampler(p), nil
+	case "ratelimited":
+		perSecond, err := strconv.ParseFloat(arg, 64)
+		if err != nil || perSecond <= 0 {
+			return nil, fmt.Errorf("Sampler '%v' needs a positive number of traces per second", spec)
+		}
+		return newRateLimitedSampler(perSecond), nil
+	default:
+		return nil, fmt.Errorf("Unknown sampler '%v', use always, never, probabilistic:P or ratelimited:N", spec)
+	}
+}
+
+type constSampler bool
+
+func (s constSampler) Sample() bool {
+	return bool(s)
+}
+
+type probabilisticSampler float64
+
+func (s probabilisticSampler) Sample() bool {
+	return rand.Float64() < float64(s)
+}
+
+// rateLimitedSampler is a token bucket that holds up to a second's worth of traces.
+type rateLimitedSampler struct {
+	mu        sync.Mutex
+	perSecond float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimitedSampler(perSecond float64) *rateLimitedSampler {
+	return &rateLimitedSampler{perSecond: perSecond, tokens: perSecond, last: time.Now()}
+}
+
+func (s *rateLimitedSampler) Sample() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.perSecond
+	if max := s.perSecond; s.tokens > max {
+		s.tokens = max
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// routeSampler overrides the sampler for requests to a path, or to every path under a prefix if
+// the pattern ends with '*'.
+type routeSampler struct {
+	pattern string
+	sampler Sampler
+}
+
+func (r routeSampler) matches(path string) bool {
+	if strings.HasSuffix(r.pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(r.pattern, "*"))
+	}
+	return path == r.pattern
+}
+
+type sampling struct {
+	sampler Sampler
+	routes  []routeSampler
+}
+
+var (
+	samplingLock sync.RWMutex
+	current      = sampling{sampler: constSampler(true)}
+)
+
+// SetSampling chooses how new traces are sampled, see ParseSampler. routes override it for HTTP
+// requests, as "pattern=sampler", e.g. "/health=never" or "/accounts/*=probabilistic:0.5"; the
+// first matching pattern wins. Nothing changes if any of them is invalid. Traces are always
+// sampled until SetSampling is called.
+func SetSampling(spec string, routes []string) error {
+	s := sampling{}
+	var err error
+	if s.sampler, err = ParseSampler(spec); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if strings.TrimSpace(route) == "" {
+			continue
+		}
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("Route sampler '%v' is not of the form pattern=sampler", route)
+		}
+		sampler, err := ParseSampler(parts[1])
+		if err != nil {
+			return err
+		}
+		s.routes = append(s.routes, routeSampler{strings.TrimSpace(parts[0]), sampler})
+	}
+	samplingLock.Lock()
+	current = s
+	samplingLock.Unlock()
+	return nil
+}
+
+// shouldSample decides for a new trace, started by a request to path or "" if it isn't.
+func shouldSample(path string) bool {
+	samplingLock.RLock()
+	s := current
+	samplingLock.RUnlock()
+	if path != "" {
+		for _, r := range s.routes {
+			if r.matches(path) {
+				return r.sampler.Sample()
+			}
+		}
+	}
+	return s.sampler.Sample()
+}
+
+// startRootSpan starts a new trace, sampled according to SetSampling. The decision is passed to
+// the tracer as the sampling.priority tag, which OpenTracing tracers honor when it is set on a
+// span and the OpenTelemetry pipeline reads from the span's start attributes.
+func startRootSpan(opName string, path string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	priority := uint16(0)
+	if shouldSample(path) {
+		priority = 1
+	}
+	opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+	span := tracer.StartSpan(opName, opts...)
+	ext.SamplingPriority.Set(span, priority)
+	return span
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseSampler(t *testing.T) {
+	Convey("Given sampler specs", t, func() {
+		Convey("Then the known strategies are parsed", func() {
+			for _, spec := range []string{"always", "Never", "probabilistic:0.25", "ratelimited:10"} {
+				_, err := ParseSampler(spec)
+				So(err, ShouldBeNil)
+			}
+		})
+
+		Convey("Then bad ones are refused", func() {
+			for _, spec := range []string{"sometimes", "always:1", "probabilistic:2", "probabilistic", "ratelimited:0"} {
+				_, err := ParseSampler(spec)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Given a sampler limited to 5 traces per second", t, func() {
+		sampler, _ := ParseSampler("ratelimited:5")
+
+		Convey("Then a burst only gets 5 traces", func() {
+			sampled := 0
+			for i := 0; i < 100; i++ {
+				if sampler.Sample() {
+					sampled++
+				}
+			}
+			So(sampled, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestSampling(t *testing.T) {
+	Convey("Given a service that samples everything but /health", t, func() {
+		mock := mocktracer.New()
+		SetTracer(mock)
+		defer SetTracer(opentracing.NoopTracer{})
+		So(SetSampling("always", []string{"/health=never", "/accounts/*=always"}), ShouldBeNil)
+		defer SetSampling("always", nil)
+
+		priority := func(span opentracing.Span) interface{} {
+			return span.(*mocktracer.MockSpan).Tag(string(ext.SamplingPriority))
+		}
+
+		Convey("Then new traces are sampled by route", func() {
+			So(priority(StartHTTPTrace(httptest.NewRequest("GET", "/health", nil), "HealthCheck")), ShouldEqual, uint16(0))
+			So(priority(StartHTTPTrace(httptest.NewRequest("GET", "/accounts/10000", nil), "GetAccount")), ShouldEqual, uint16(1))
+		})
+
+		Convey("Then a request that carries a trace keeps the caller's decision", func() {
+			req := httptest.NewRequest("GET", "/health", nil)
+			parent := mock.StartSpan("caller")
+			mock.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+			So(priority(StartHTTPTrace(req, "HealthCheck")), ShouldBeNil)
+		})
+
+		Convey("Then invalid changes are refused and the current sampling is kept", func() {
+			So(SetSampling("never", []string{"/health"}), ShouldNotBeNil)
+			So(shouldSample("/accounts/10000"), ShouldBeTrue)
+			So(shouldSample("/health"), ShouldBeFalse)
+		})
+
+		Convey("Then sampling can be changed at runtime", func() {
+			So(SetSampling("never", nil), ShouldBeNil)
+			So(shouldSample("/accounts/10000"), ShouldBeFalse)
+		})
+	})
+}
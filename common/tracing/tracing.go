@@ -12,7 +12,8 @@ import (
 	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 )
 
-var tracer opentracing.Tracer
+// tracer is a no-op until InitTracing or Init succeeds, so services and tests work without one.
+var tracer opentracing.Tracer = opentracing.NoopTracer{}
 
 // SetTracer can be used by unit tests to provide a NoopTracer instance. Real users should always
 // use the InitTracing func.
@@ -20,37 +21,45 @@ func SetTracer(initializedTracer opentracing.Tracer) {
 	tracer = initializedTracer
 }
 
-// InitTracing connects the calling service to Zipkin and initializes the tracer.
-func InitTracing(zipkinURL string, serviceName string) {
+// InitTracing connects the calling service to Zipkin and initializes the tracer. If that fails the
+// error is returned and logged, and the service carries on with a no-op tracer.
+func InitTracing(zipkinURL string, serviceName string) error {
+	url := fmt.Sprintf("%s/api/v1/spans", zipkinURL)
 	logrus.Infof("Connecting to zipkin server at %v", zipkinURL)
-	collector, err := zipkin.NewHTTPCollector(
-		fmt.Sprintf("%s/api/v1/spans", zipkinURL))
+	collector, err := zipkin.NewHTTPCollector(url, zipkin.HTTPLogger(zipkin.LoggerFunc(logCollectorEvent)))
 	if err != nil {
-		logrus.Info("Error connecting to zipkin server at " +
-			fmt.Sprintf("%s/api/v1/spans", zipkinURL) + ". Error: " + err.Error())
-		logrus.Errorln("Error connecting to zipkin server at " +
-			fmt.Sprintf("%s/api/v1/spans", zipkinURL) + ". Error: " + err.Error())
-		panic("Error connecting to zipkin server at " +
-			fmt.Sprintf("%s/api/v1/spans", zipkinURL) + ". Error: " + err.Error())
+		logrus.Errorf("Error connecting to zipkin server at %v, tracing is disabled. Error: %v", url, err)
+		return err
 	}
-	tracer, err = zipkin.NewTracer(
+	zipkinTracer, err := zipkin.NewTracer(
 		zipkin.NewRecorder(collector, false, "127.0.0.1:0", serviceName))
 	if err != nil {
-		logrus.Errorln("Error starting new zipkin tracer. Error: " + err.Error())
-		panic("Error starting new zipkin tracer. Error: " + err.Error())
+		logrus.Errorf("Error starting new zipkin tracer, tracing is disabled. Error: %v", err)
+		return err
 	}
+	SetTracer(zipkinTracer)
 	logrus.Infof("Successfully started zipkin tracer for service '%v'", serviceName)
+	return nil
 }
 
-// StartHTTPTrace loads tracing information from an INCOMING HTTP request.
+// logCollectorEvent receives the key/value pairs the Zipkin collector logs, which are all about
+// spans it failed to send.
+func logCollectorEvent(keyvals ...interface{}) error {
+	reportExportFailure(fmt.Errorf("%v", keyvals))
+	return nil
+}
+
+// StartHTTPTrace loads tracing information from an INCOMING HTTP request, in any of the formats
+// described at SetPropagation. Requests without it start a new trace, sampled as set with
+// SetSampling.
 func StartHTTPTrace(r *http.Request, opName string) opentracing.Span {
 	carrier := opentracing.HTTPHeadersCarrier(r.Header)
-	clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
+	clientContext, err := extractSpanContext(carrier)
 	if err == nil {
 		return tracer.StartSpan(
 			opName, ext.RPCServerOption(clientContext))
 	} else {
-		return tracer.StartSpan(opName)
+		return startRootSpan(opName, r.URL.Path)
 	}
 }
 
@@ -61,36 +70,57 @@ func UpdateContext(ctx context.Context, span opentracing.Span) context.Context {
 
 // StartChildSpanFromContext starts a child span from span within the supplied context, if available.
 func StartChildSpanFromContext(ctx context.Context, opName string) opentracing.Span {
-	if ctx.Value("opentracing-span") == nil {
-		return tracer.StartSpan(opName, ext.RPCServerOption(nil))
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return startRootSpan(opName, "", ext.RPCServerOption(nil))
 	}
-	parent := ctx.Value("opentracing-span").(opentracing.Span)
-	child := tracer.StartSpan(opName, opentracing.ChildOf(parent.Context()))
-	return child
+	return tracer.StartSpan(opName, opentracing.ChildOf(parent.Context()))
 }
 
+// StartSpanFromContextWithLogEvent starts a child of the span within ctx, or a new trace if there is
+// none, and logs logStatement on it.
 func StartSpanFromContextWithLogEvent(ctx context.Context, opName string, logStatement string) opentracing.Span {
-	span := ctx.Value("opentracing-span").(opentracing.Span)
-	child := tracer.StartSpan(opName, ext.RPCServerOption(span.Context()))
+	var child opentracing.Span
+	if span := SpanFromContext(ctx); span != nil {
+		child = tracer.StartSpan(opName, ext.RPCServerOption(span.Context()))
+	} else {
+		child = startRootSpan(opName, "")
+	}
 	child.LogEvent(logStatement)
 	return child
 }
 
+// CloseSpan logs event on span and finishes it. A nil span is ignored.
 func CloseSpan(span opentracing.Span, event string) {
+	if span == nil {
+		return
+	}
 	span.LogEvent(event)
 	span.Finish()
 }
 
+// AddTracingToReqFromContext injects the span within ctx, if any, into the headers of an OUTGOING
+// HTTP request. Failures are counted and logged, the request is sent without them.
 func AddTracingToReqFromContext(ctx context.Context, req *http.Request) {
-	if ctx.Value("opentracing-span") == nil {
+	span := SpanFromContext(ctx)
+	if span == nil {
 		return
 	}
 	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	err := tracer.Inject(
-		ctx.Value("opentracing-span").(opentracing.Span).Context(),
-		opentracing.HTTPHeaders,
-		carrier)
-	if err != nil {
-		panic("Unable to inject tracing context: " + err.Error())
+	if err := injectSpanContext(span.Context(), carrier); err != nil {
+		reportPropagationFailure(err)
+	}
+}
+
+// SpanIDs returns the trace and span ID of span as hex strings, or empty strings if span is nil or
+// the tracer doesn't pass them on as B3, like the no-op tracer.
+func SpanIDs(span opentracing.Span) (traceID string, spanID string) {
+	if span == nil {
+		return "", ""
+	}
+	b3 := textMap{}
+	if err := tracer.Inject(span.Context(), opentracing.TextMap, b3); err != nil {
+		return "", ""
 	}
+	return b3[b3TraceID], b3[b3SpanID]
 }
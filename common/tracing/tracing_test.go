@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failingTracer can't inject span contexts.
+type failingTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t failingTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	return errors.New("inject failed")
+}
+
+func TestWithoutTracer(t *testing.T) {
+	Convey("Given a service that never initialized tracing", t, func() {
+		Convey("Then the helpers work without a span in the context", func() {
+			span := StartHTTPTrace(httptest.NewRequest("GET", "/accounts/10000", nil), "GetAccount")
+			So(span, ShouldNotBeNil)
+			ctx := context.Background()
+			So(func() { CloseSpan(StartSpanFromContextWithLogEvent(ctx, "GetAccount", "Start"), "done") }, ShouldNotPanic)
+			So(func() { AddTracingToReqFromContext(ctx, httptest.NewRequest("GET", "/", nil)) }, ShouldNotPanic)
+			So(func() { CloseSpan(nil, "done") }, ShouldNotPanic)
+			CloseSpan(StartChildSpanFromContext(UpdateContext(ctx, span), "QueryAccount"), "done")
+		})
+	})
+
+	Convey("Given a tracer that fails to inject", t, func() {
+		SetTracer(failingTracer{mocktracer.New()})
+		defer SetTracer(opentracing.NoopTracer{})
+		before := propagationFailures.Value()
+
+		Convey("When a request is sent within a span", func() {
+			ctx := UpdateContext(context.Background(), tracer.StartSpan("GetAccount"))
+			req := httptest.NewRequest("GET", "/", nil)
+
+			Convey("Then it goes out without a trace context and the failure is counted", func() {
+				So(func() { AddTracingToReqFromContext(ctx, req) }, ShouldNotPanic)
+				So(propagationFailures.Value(), ShouldEqual, before+1)
+			})
+		})
+	})
+}
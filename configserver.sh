@@ -0,0 +1,13 @@
+export GOOS=linux
+export CGO_ENABLED=0
+
+cd configserver;go get;go build -o configserver-linux-amd64;echo built `pwd`;cd ..
+
+export GOOS=darwin
+
+# configserver/config-repo is mounted rather than baked into the image, so edits to it are picked up
+# by the poller and published on the bus. The bind mount needs the directory on the node running the
+# service, as on a single node swarm.
+docker build -t linhnh123/configserver configserver/
+docker service rm configserver
+docker service create --replicas 1 --name configserver -p 8888:8888 --network my_network --update-delay 10s --with-registry-auth  --update-parallelism 1 --mount type=bind,source=`pwd`/configserver/config-repo,target=/config-repo linhnh123/configserver
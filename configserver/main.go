@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/linhnh123/golang-microservices-tutorial/configserver/repository"
+)
+
+var appName = "configserver"
+
+var (
+	port         *string
+	repoDir      *string
+	amqpUrl      *string
+	eventBus     *string
+	pollInterval *time.Duration
+)
+
+var repo repository.Repository
+var messagingClient messaging.IMessagingClient
+var server = &http.Server{}
+
+func init() {
+	port = flag.String("port", "8888", "HTTP port for the config server")
+	repoDir = flag.String("repo", "config-repo", "Directory or local git repository with configuration files")
+	amqpUrl = flag.String("amqpServerUrl", "", "Broker to publish refresh events on when files change, none if empty")
+	eventBus = flag.String("configEventBus", "springCloudBus", "Exchange to publish refresh events on")
+	pollInterval = flag.Duration("poll", 5*time.Second, "How often to check the repository for changes")
+	flag.Parse()
+}
+
+func main() {
+	log.Println("Starting " + appName + "...")
+
+	var err error
+	repo, err = repository.Open(*repoDir)
+	if err != nil {
+		log.Fatalf("Couldn't open config repository %v: %v", *repoDir, err)
+	}
+	log.Printf("Serving configuration from %v", repo.Name())
+
+	if *amqpUrl != "" {
+		messagingClient = messaging.NewMessagingClient(*amqpUrl)
+		messagingClient.ConnectToBroker(*amqpUrl)
+	}
+	stopWatching := make(chan struct{})
+	go watchRepository(stopWatching)
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/health").HandlerFunc(health)
+	r.Methods("GET").Path("/{application}/{profile}").HandlerFunc(getEnvironment)
+	r.Methods("GET").Path("/{application}/{profile}/{label}").HandlerFunc(getEnvironment)
+	server.Addr = ":" + *port
+	server.Handler = r
+
+	shutdownComplete := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		close(stopWatching)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		if messagingClient != nil {
+			messagingClient.Close()
+		}
+		close(shutdownComplete)
+	}()
+
+	log.Println("Starting HTTP service at " + *port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error HTTP %v: %v", *port, err)
+		os.Exit(1)
+	}
+	<-shutdownComplete
+	log.Println(appName + " stopped")
+}
+
+// getEnvironment serves /{application}/{profile}/{label} like the Spring Cloud Config server.
+func getEnvironment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	env, err := repository.LoadEnvironment(repo, vars["application"], vars["profile"], vars["label"])
+	if err != nil {
+		log.Printf("Couldn't serve %v: %v", r.URL.Path, err)
+		status := http.StatusInternalServerError
+		if _, ok := err.(repository.ErrUnknownLabel); ok {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	data, _ := json.Marshal(env)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"UP"}`))
+}
+
+// watchRepository polls the repository and publishes refresh events for the files that changed.
+func watchRepository(stop <-chan struct{}) {
+	before, err := repo.Snapshot()
+	if err != nil {
+		log.Printf("Couldn't read config repository, not watching it for changes: %v", err)
+		return
+	}
+	ticker := time.NewTicker(*pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		after, err := repo.Snapshot()
+		if err != nil {
+			log.Printf("Couldn't check config repository for changes: %v", err)
+			continue
+		}
+		changed := repository.Changed(before, after)
+		before = after
+		if len(changed) == 0 {
+			continue
+		}
+		log.Printf("Configuration changed: %v", changed)
+		destinations := map[string]bool{}
+		for _, file := range changed {
+			for _, destination := range repository.Destinations(file) {
+				destinations[destination] = true
+			}
+		}
+		for destination := range destinations {
+			publishRefresh(destination)
+		}
+	}
+}
+
+func publishRefresh(destination string) {
+	if messagingClient == nil {
+		return
+	}
+	event := config.UpdateToken{
+		Type:               "RefreshRemoteApplicationEvent",
+		Timestamp:          time.Now().UnixNano() / int64(time.Millisecond),
+		OriginService:      appName + ":" + *port + ":" + config.InstanceID,
+		DestinationService: destination,
+		Id:                 messaging.NewMessageID(),
+	}
+	body, _ := json.Marshal(event)
+	if err := messagingClient.Publish(body, *eventBus, "topic"); err != nil {
+		log.Printf("Couldn't publish refresh event for %v: %v", destination, err)
+	}
+}
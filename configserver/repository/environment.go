@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/magiconair/properties"
+	"gopkg.in/yaml.v2"
+)
+
+// Extensions of the files that are served, in the order they are looked up.
+var extensions = []string{".yml", ".yaml", ".properties", ".json"}
+
+// The base name of files with properties for every application.
+const sharedName = "application"
+
+// Environment is the JSON document Spring Cloud Config clients expect from /{app}/{profile}/{label}.
+type Environment struct {
+	Name            string           `json:"name"`
+	Profiles        []string         `json:"profiles"`
+	Label           string           `json:"label"`
+	Version         string           `json:"version"`
+	PropertySources []PropertySource `json:"propertySources"`
+}
+
+// PropertySource holds the properties from a single file, with flattened keys.
+type PropertySource struct {
+	Name   string                 `json:"name"`
+	Source map[string]interface{} `json:"source"`
+}
+
+// LoadEnvironment collects the files for app and profiles at label. Like the Spring Cloud Config
+// server, property sources are returned with the highest precedence first: later profiles before
+// earlier ones, profile specific files before plain ones, and app files before application files.
+// profiles is a comma separated list.
+func LoadEnvironment(repo Repository, app string, profiles string, label string) (Environment, error) {
+	if label == "" {
+		label = repo.DefaultLabel()
+	}
+	// Spring's way of putting a '/' in a label that is part of the path.
+	label = strings.Replace(label, "(_)", "/", -1)
+	if !validName(app) || !validName(profiles) {
+		return Environment{}, fmt.Errorf("Invalid application or profile name")
+	}
+
+	env := Environment{Name: app, Profiles: strings.Split(profiles, ","), Label: label}
+	version, err := repo.Version(label)
+	if err != nil {
+		return env, err
+	}
+	env.Version = version
+
+	names := []string{}
+	for i := len(env.Profiles) - 1; i >= 0; i-- {
+		names = append(names, app+"-"+env.Profiles[i], sharedName+"-"+env.Profiles[i])
+	}
+	names = append(names, app, sharedName)
+
+	env.PropertySources = []PropertySource{}
+	for _, name := range names {
+		for _, ext := range extensions {
+			data, err := repo.ReadFile(label, name+ext)
+			if err != nil {
+				return env, err
+			}
+			if data == nil {
+				continue
+			}
+			source, err := parseFile(name+ext, data)
+			if err != nil {
+				return env, err
+			}
+			env.PropertySources = append(env.PropertySources, PropertySource{
+				Name:   repo.Name() + "/" + name + ext,
+				Source: source,
+			})
+		}
+	}
+	return env, nil
+}
+
+// parseFile reads a configuration file into a map with dotted keys, e.g. amqp_topology.queues.vip.name,
+// and list items indexed like Spring's, e.g. routes[0]. The case of keys is kept, since clients bind
+// camelCase keys like hystrix.command.imageservice.Timeout.
+func parseFile(name string, data []byte) (map[string]interface{}, error) {
+	source := make(map[string]interface{})
+	switch filepath.Ext(name) {
+	case ".properties":
+		// Not expanded, ${...} placeholders are resolved by the clients like with Spring.
+		loader := properties.Loader{Encoding: properties.ISO_8859_1, DisableExpansion: true}
+		props, err := loader.LoadBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse %v: %v", name, err)
+		}
+		for _, key := range props.Keys() {
+			source[key], _ = props.Get(key)
+		}
+	case ".json":
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Couldn't parse %v: %v", name, err)
+		}
+		flatten("", doc, source)
+	default:
+		var doc map[interface{}]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Couldn't parse %v: %v", name, err)
+		}
+		flatten("", doc, source)
+	}
+	return source, nil
+}
+
+// flatten adds the leaves of value to source, with their path from prefix as key.
+func flatten(prefix string, value interface{}, source map[string]interface{}) {
+	child := func(key interface{}) string {
+		if prefix == "" {
+			return fmt.Sprint(key)
+		}
+		return prefix + "." + fmt.Sprint(key)
+	}
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			flatten(child(key), item, source)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			flatten(child(key), item, source)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flatten(fmt.Sprintf("%v[%d]", prefix, i), item, source)
+		}
+	default:
+		source[prefix] = v
+	}
+}
+
+// Destinations returns the bus destinations to refresh when file changes. A file name like
+// quotes-service-test.yml can't be told apart from the test profile of quotes-service or the
+// service-test profile of quotes, so every application it could belong to is refreshed.
+func Destinations(file string) []string {
+	// Git snapshots prefix file names with the branch.
+	if i := strings.LastIndex(file, ":"); i >= 0 {
+		file = file[i+1:]
+	}
+	stem := strings.TrimSuffix(file, filepath.Ext(file))
+	if stem == sharedName || strings.HasPrefix(stem, sharedName+"-") {
+		return []string{"**"}
+	}
+	destinations := []string{stem + ":**"}
+	for i := len(stem) - 1; i > 0; i-- {
+		if stem[i] == '-' {
+			destinations = append(destinations, stem[:i]+":**")
+		}
+	}
+	return destinations
+}
+
+// Changed returns the files that differ between two snapshots, including added and removed files.
+func Changed(before map[string]string, after map[string]string) []string {
+	changed := []string{}
+	for file, hash := range after {
+		if before[file] != hash {
+			changed = append(changed, file)
+		}
+	}
+	for file := range before {
+		if _, ok := after[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func isConfigFile(name string) bool {
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\:`) && !strings.HasPrefix(name, ".")
+}
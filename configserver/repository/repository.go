@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Repository gives access to the configuration files the config server serves.
+type Repository interface {
+	// Name identifies the repository in property source names.
+	Name() string
+	// DefaultLabel is used when a request has no label.
+	DefaultLabel() string
+	// ReadFile returns the contents of name at label, or nil if there is no such file.
+	ReadFile(label string, name string) ([]byte, error)
+	// Version returns the version of the files at label, or "" if the repository isn't versioned.
+	Version(label string) (string, error)
+	// Snapshot returns a hash of the contents of every file, by file name. Comparing two snapshots
+	// tells which files have changed.
+	Snapshot() (map[string]string, error)
+}
+
+// ErrUnknownLabel is returned for labels the repository doesn't have.
+type ErrUnknownLabel string
+
+func (e ErrUnknownLabel) Error() string {
+	return fmt.Sprintf("No such label: %v", string(e))
+}
+
+// Open returns a repository for dir, which is a git repository if it has a .git directory and a plain
+// directory otherwise.
+func Open(dir string) (Repository, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return &gitRepository{dir: dir}, nil
+	}
+	return &dirRepository{dir: dir}, nil
+}
+
+// dirRepository serves the files in a directory, whatever the label.
+type dirRepository struct {
+	dir string
+}
+
+func (r *dirRepository) Name() string {
+	return "file:" + r.dir
+}
+
+func (r *dirRepository) DefaultLabel() string {
+	return "master"
+}
+
+func (r *dirRepository) ReadFile(label string, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (r *dirRepository) Version(label string) (string, error) {
+	return "", nil
+}
+
+func (r *dirRepository) Snapshot() (map[string]string, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() || !isConfigFile(file.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(data)
+		snapshot[file.Name()] = hex.EncodeToString(sum[:])
+	}
+	return snapshot, nil
+}
+
+// gitRepository serves the files committed to a local git repository, where labels are branches,
+// tags or commits. Uncommitted changes are not served.
+type gitRepository struct {
+	dir string
+}
+
+func (r *gitRepository) Name() string {
+	return "file:" + r.dir
+}
+
+func (r *gitRepository) DefaultLabel() string {
+	if branch, err := r.git("symbolic-ref", "--short", "HEAD"); err == nil {
+		return strings.TrimSpace(branch)
+	}
+	return "master"
+}
+
+func (r *gitRepository) ReadFile(label string, name string) ([]byte, error) {
+	if _, err := r.Version(label); err != nil {
+		return nil, err
+	}
+	if _, err := r.git("cat-file", "-e", label+":"+name); err != nil {
+		return nil, nil
+	}
+	data, err := r.git("show", label+":"+name)
+	return []byte(data), err
+}
+
+func (r *gitRepository) Version(label string) (string, error) {
+	// Labels come from request paths, don't let them pass for options.
+	if label == "" || strings.HasPrefix(label, "-") {
+		return "", ErrUnknownLabel(label)
+	}
+	version, err := r.git("rev-parse", "--verify", "--quiet", label+"^{commit}")
+	if err != nil {
+		return "", ErrUnknownLabel(label)
+	}
+	return strings.TrimSpace(version), nil
+}
+
+// Snapshot covers every branch, with file names prefixed by the branch, e.g. P13:accountservice-test.yml.
+func (r *gitRepository) Snapshot() (map[string]string, error) {
+	branches, err := r.git("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]string)
+	for _, branch := range strings.Fields(branches) {
+		// Lines are "<mode> blob <hash>\t<name>".
+		tree, err := r.git("ls-tree", branch)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(tree, "\n") {
+			parts := strings.SplitN(line, "\t", 2)
+			fields := strings.Fields(parts[0])
+			if len(parts) != 2 || len(fields) != 3 || fields[1] != "blob" || !isConfigFile(parts[1]) {
+				continue
+			}
+			snapshot[branch+":"+parts[1]] = fields[2]
+		}
+	}
+	return snapshot, nil
+}
+
+func (r *gitRepository) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", r.dir}, args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %v: %v", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return string(out), nil
+}
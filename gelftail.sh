@@ -7,4 +7,4 @@ export GOOS=darwin
 
 docker build -t linhnh123/gelftail gelftail/
 docker service rm gelftail
-docker service create --name=gelftail -p=12202:12202/udp --replicas=1 --network=my_network linhnh123/gelftail
\ No newline at end of file
+docker service create --name=gelftail -p=12202:12202/udp -p=12202:12202/tcp --replicas=1 --network=my_network linhnh123/gelftail
\ No newline at end of file
@@ -0,0 +1,167 @@
+// Package gelf decodes GELF 1.1 messages received over UDP: chunked messages are put back together
+// and GZIP or ZLIB compressed ones are uncompressed, see https://docs.graylog.org/docs/gelf.
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// MaxDatagramSize is the largest UDP datagram a GELF message or chunk can arrive in.
+const MaxDatagramSize = 65536
+
+// MaxChunks is the most chunks the GELF spec allows a message to be split into.
+const MaxChunks = 128
+
+var (
+	chunkMagic = []byte{0x1e, 0x0f}
+	gzipMagic  = []byte{0x1f, 0x8b}
+)
+
+// A chunk is the magic bytes, an 8 byte message ID, its sequence number and the sequence count.
+const chunkHeaderSize = 2 + 8 + 1 + 1
+
+// Decoder turns datagrams into GELF messages. It is safe for concurrent use.
+type Decoder struct {
+	// ChunkTimeout is how long the chunks of a message are kept waiting for the rest.
+	ChunkTimeout time.Duration
+	// MaxPending is how many chunked messages can be waiting for chunks. When it is reached, the
+	// chunks of new messages are dropped until the waiting ones are complete or timed out.
+	MaxPending int
+	// MaxMessageSize is the most bytes a message may uncompress to.
+	MaxMessageSize int64
+
+	lock    sync.Mutex
+	pending map[string]*chunkedMessage
+	// now is replaced by tests.
+	now func() time.Time
+}
+
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// NewDecoder returns a decoder with the given chunk timeout and limit on pending messages, that
+// uncompresses messages up to 1 MB.
+func NewDecoder(chunkTimeout time.Duration, maxPending int) *Decoder {
+	return &Decoder{
+		ChunkTimeout:   chunkTimeout,
+		MaxPending:     maxPending,
+		MaxMessageSize: 1 << 20,
+		pending:        map[string]*chunkedMessage{},
+		now:            time.Now,
+	}
+}
+
+// Decode returns the uncompressed GELF message in datagram. If datagram is a chunk of a message
+// that isn't complete yet, nil is returned without an error.
+func (d *Decoder) Decode(datagram []byte) ([]byte, error) {
+	if bytes.HasPrefix(datagram, chunkMagic) {
+		message, err := d.addChunk(datagram)
+		if message == nil || err != nil {
+			return nil, err
+		}
+		datagram = message
+	}
+	return d.uncompress(datagram)
+}
+
+// Pending returns the number of chunked messages waiting for chunks.
+func (d *Decoder) Pending() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.pending)
+}
+
+// addChunk stores chunk, and returns the message it belongs to once all of its chunks are in.
+func (d *Decoder) addChunk(chunk []byte) ([]byte, error) {
+	if len(chunk) <= chunkHeaderSize {
+		return nil, fmt.Errorf("GELF chunk of %v bytes is too short", len(chunk))
+	}
+	id := string(chunk[2:10])
+	seq, count := int(chunk[10]), int(chunk[11])
+	if count == 0 || count > MaxChunks || seq >= count {
+		return nil, fmt.Errorf("GELF chunk %v of %v is out of range", seq, count)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := d.now()
+	d.expire(now)
+
+	message := d.pending[id]
+	if message == nil {
+		if len(d.pending) >= d.MaxPending {
+			return nil, fmt.Errorf("Dropping GELF chunk, %v messages are already waiting for chunks", len(d.pending))
+		}
+		message = &chunkedMessage{chunks: make([][]byte, count), started: now}
+		d.pending[id] = message
+	}
+	if len(message.chunks) != count {
+		return nil, fmt.Errorf("GELF chunk says %v chunks, earlier ones said %v", count, len(message.chunks))
+	}
+	if message.chunks[seq] != nil {
+		return nil, nil // A duplicate
+	}
+	if int64(message.size+len(chunk)-chunkHeaderSize) > d.MaxMessageSize {
+		delete(d.pending, id)
+		return nil, fmt.Errorf("Dropping chunked GELF message larger than %v bytes", d.MaxMessageSize)
+	}
+	message.chunks[seq] = append([]byte{}, chunk[chunkHeaderSize:]...)
+	message.received++
+	message.size += len(chunk) - chunkHeaderSize
+	if message.received < count {
+		return nil, nil
+	}
+	delete(d.pending, id)
+	return bytes.Join(message.chunks, nil), nil
+}
+
+// expire drops the messages whose chunks didn't all arrive within ChunkTimeout.
+func (d *Decoder) expire(now time.Time) {
+	for id, message := range d.pending {
+		if now.Sub(message.started) > d.ChunkTimeout {
+			delete(d.pending, id)
+		}
+	}
+}
+
+// uncompress returns data, uncompressed if it starts like GZIP or ZLIB data.
+func (d *Decoder) uncompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case isZlib(data):
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Problem uncompressing GELF message: %v", err)
+	}
+	defer reader.Close()
+	message, err := ioutil.ReadAll(io.LimitReader(reader, d.MaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Problem uncompressing GELF message: %v", err)
+	}
+	if int64(len(message)) > d.MaxMessageSize {
+		return nil, fmt.Errorf("GELF message uncompresses to more than %v bytes", d.MaxMessageSize)
+	}
+	return message, nil
+}
+
+// isZlib tells if data starts with a ZLIB header using deflate, which JSON never does.
+func isZlib(data []byte) bool {
+	return len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
@@ -0,0 +1,127 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const message = `{"version":"1.1","host":"accountservice","short_message":"{\"level\":\"info\",\"msg\":\"Account found\"}"}`
+
+func gzipped(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func zlibbed(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// chunk splits data into count chunks of the message with the given ID.
+func chunk(id string, data []byte, count int) [][]byte {
+	size := (len(data) + count - 1) / count
+	chunks := [][]byte{}
+	for i := 0; i < count; i++ {
+		start, end := i*size, (i+1)*size
+		if start > len(data) {
+			start = len(data)
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		header := append(append([]byte{0x1e, 0x0f}, []byte(id)...), byte(i), byte(count))
+		chunks = append(chunks, append(header, data[start:end]...))
+	}
+	return chunks
+}
+
+func TestDecode(t *testing.T) {
+	Convey("Given a decoder", t, func() {
+		decoder := NewDecoder(5*time.Second, 2)
+		now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+		decoder.now = func() time.Time { return now }
+
+		Convey("Uncompressed messages are passed on as they are", func() {
+			out, err := decoder.Decode([]byte(message))
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, message)
+		})
+
+		Convey("GZIP and ZLIB compressed messages are uncompressed", func() {
+			out, err := decoder.Decode(gzipped([]byte(message)))
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, message)
+
+			out, err = decoder.Decode(zlibbed([]byte(message)))
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, message)
+		})
+
+		Convey("Chunked messages are put together once every chunk is in, in any order", func() {
+			chunks := chunk("msg00001", gzipped([]byte(message)), 3)
+
+			out, err := decoder.Decode(chunks[2])
+			So(out, ShouldBeNil)
+			So(err, ShouldBeNil)
+			out, err = decoder.Decode(chunks[0])
+			So(out, ShouldBeNil)
+			out, err = decoder.Decode(chunks[0]) // Duplicates are ignored
+			So(out, ShouldBeNil)
+			So(err, ShouldBeNil)
+			out, err = decoder.Decode(chunks[1])
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, message)
+			So(decoder.Pending(), ShouldEqual, 0)
+		})
+
+		Convey("Chunked messages that don't complete in time are dropped", func() {
+			chunks := chunk("msg00002", []byte(message), 2)
+			decoder.Decode(chunks[0])
+			now = now.Add(6 * time.Second)
+
+			out, err := decoder.Decode(chunk("msg00003", []byte(message), 2)[0])
+			So(out, ShouldBeNil)
+			So(err, ShouldBeNil)
+			So(decoder.Pending(), ShouldEqual, 1)
+			out, _ = decoder.Decode(chunks[1])
+			So(out, ShouldBeNil)
+		})
+
+		Convey("Chunks of new messages are dropped while too many are waiting", func() {
+			decoder.Decode(chunk("msg00004", []byte(message), 2)[0])
+			decoder.Decode(chunk("msg00005", []byte(message), 2)[0])
+
+			_, err := decoder.Decode(chunk("msg00006", []byte(message), 2)[0])
+			So(err, ShouldNotBeNil)
+			So(decoder.Pending(), ShouldEqual, 2)
+		})
+
+		Convey("Chunks out of range are refused", func() {
+			bad := chunk("msg00007", []byte(message), 2)[1]
+			bad[10] = 2
+			_, err := decoder.Decode(bad)
+			So(err, ShouldNotBeNil)
+
+			_, err = decoder.Decode(chunk("msg00008", []byte(message), MaxChunks+1)[0])
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Messages uncompressing to more than the limit are refused", func() {
+			decoder.MaxMessageSize = 1024
+			_, err := decoder.Decode(gzipped([]byte(strings.Repeat(" ", 4096))))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
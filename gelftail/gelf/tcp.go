@@ -0,0 +1,174 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPOptions limits what clients of a TCPServer can do.
+type TCPOptions struct {
+	// MaxConnections is how many clients can be connected at a time. More are disconnected right away.
+	MaxConnections int
+	// IdleTimeout is how long a client can go without sending anything before it is disconnected.
+	IdleTimeout time.Duration
+	// MaxMessageSize is the most bytes a message may have. Clients sending larger ones are disconnected.
+	MaxMessageSize int
+	// OnClose, if set, is called with the statistics of every connection that is closed.
+	OnClose func(stats ConnStats)
+}
+
+// ConnStats tells what a client sent over a connection.
+type ConnStats struct {
+	RemoteAddr string
+	Opened     time.Time
+	Closed     time.Time
+	Messages   int
+	Bytes      int64
+	// Err is why the connection was closed by the server, nil if the client closed it.
+	Err error
+}
+
+// TCPServer receives GELF messages over TCP, where every message is followed by a null byte.
+type TCPServer struct {
+	opts     TCPOptions
+	listener net.Listener
+	slots    chan struct{}
+	conns    sync.WaitGroup
+}
+
+// ListenTCP starts listening on addr, using TLS if tlsConfig isn't nil. Options left at zero
+// allow 100 connections of 1 MB messages, that are never idle.
+func ListenTCP(addr string, tlsConfig *tls.Config, opts TCPOptions) (*TCPServer, error) {
+	if opts.MaxConnections <= 0 {
+		opts.MaxConnections = 100
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = 1 << 20
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return &TCPServer{opts: opts, listener: listener, slots: make(chan struct{}, opts.MaxConnections)}, nil
+}
+
+// LoadTLSConfig returns a TLS configuration using the certificate and key in the given PEM files.
+func LoadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Addr is the address the server listens on.
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections. Clients already connected are served until they disconnect
+// or time out.
+func (s *TCPServer) Close() error {
+	return s.listener.Close()
+}
+
+// Serve calls handle with every message received, from a goroutine per connection, until the
+// server is closed.
+func (s *TCPServer) Serve(handle func(message []byte)) error {
+	defer s.conns.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			log.Printf("Refusing GELF TCP connection from %v, %v clients are connected\n", conn.RemoteAddr(), s.opts.MaxConnections)
+			conn.Close()
+			continue
+		}
+		s.conns.Add(1)
+		go func() {
+			defer func() { <-s.slots }()
+			defer s.conns.Done()
+			s.serveConn(conn, handle)
+		}()
+	}
+}
+
+func (s *TCPServer) serveConn(conn net.Conn, handle func(message []byte)) {
+	stats := ConnStats{RemoteAddr: conn.RemoteAddr().String(), Opened: time.Now()}
+	defer func() {
+		conn.Close()
+		stats.Closed = time.Now()
+		if s.opts.OnClose != nil {
+			s.opts.OnClose(stats)
+		}
+	}()
+
+	var reader io.Reader = conn
+	if s.opts.IdleTimeout > 0 {
+		reader = idleConn{Conn: conn, timeout: s.opts.IdleTimeout}
+	}
+	scanner := bufio.NewScanner(reader)
+	// The scanner allows tokens as large as the buffer it starts with.
+	initial := 4096
+	if initial > s.opts.MaxMessageSize+1 {
+		initial = s.opts.MaxMessageSize + 1
+	}
+	scanner.Buffer(make([]byte, 0, initial), s.opts.MaxMessageSize+1)
+	scanner.Split(scanNullTerminated)
+	for {
+		if !scanner.Scan() {
+			stats.Err = scanner.Err()
+			return
+		}
+		message := scanner.Bytes()
+		stats.Bytes += int64(len(message)) + 1
+		if len(message) == 0 {
+			continue
+		}
+		stats.Messages++
+		handle(append([]byte{}, message...))
+	}
+}
+
+// idleConn moves the read deadline before every read, so a client is only disconnected when it
+// sends nothing for timeout, not when a large message takes longer than that to arrive.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// scanNullTerminated splits input into messages at null bytes. A message that isn't followed by
+// one before the client disconnects is passed on as well.
+func scanNullTerminated(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
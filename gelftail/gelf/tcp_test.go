@@ -0,0 +1,122 @@
+package gelf
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// serve starts a server on a free port, that passes the messages it receives and the statistics of
+// closed connections on.
+func serve(tlsConfig *tls.Config, opts TCPOptions) (*TCPServer, chan string, chan ConnStats) {
+	messages := make(chan string, 10)
+	closed := make(chan ConnStats, 10)
+	opts.OnClose = func(stats ConnStats) { closed <- stats }
+	server, err := ListenTCP("127.0.0.1:0", tlsConfig, opts)
+	So(err, ShouldBeNil)
+	go server.Serve(func(message []byte) { messages <- string(message) })
+	return server, messages, closed
+}
+
+func TestTCPServer(t *testing.T) {
+	Convey("Given a GELF TCP server", t, func() {
+		server, messages, closed := serve(nil, TCPOptions{MaxConnections: 1, IdleTimeout: 200 * time.Millisecond, MaxMessageSize: 64})
+		defer server.Close()
+
+		Convey("When a client sends null terminated messages", func() {
+			conn, err := net.Dial("tcp", server.Addr().String())
+			So(err, ShouldBeNil)
+			conn.Write([]byte(message[:20]))
+			conn.Write([]byte(`{"a":1}` + "\x00" + `{"b":2}` + "\x00"))
+			conn.Close()
+
+			Convey("Then each of them is handled, and counted when the client disconnects", func() {
+				So(<-messages, ShouldEqual, message[:20]+`{"a":1}`)
+				So(<-messages, ShouldEqual, `{"b":2}`)
+				stats := <-closed
+				So(stats.Messages, ShouldEqual, 2)
+				So(stats.Bytes, ShouldEqual, 36)
+				So(stats.Err, ShouldBeNil)
+			})
+		})
+
+		Convey("When a client sends a message that is too large", func() {
+			conn, _ := net.Dial("tcp", server.Addr().String())
+			defer conn.Close()
+			conn.Write([]byte(strings.Repeat("x", 100) + "\x00"))
+
+			Convey("Then it is disconnected", func() {
+				So((<-closed).Err, ShouldNotBeNil)
+				So(len(messages), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When a message takes longer than the idle timeout to arrive, but data keeps coming", func() {
+			conn, _ := net.Dial("tcp", server.Addr().String())
+			defer conn.Close()
+			for i := 0; i < 4; i++ {
+				conn.Write([]byte(strings.Repeat("x", 10)))
+				time.Sleep(100 * time.Millisecond)
+			}
+			conn.Write([]byte("\x00"))
+
+			Convey("Then it is handled", func() {
+				So(<-messages, ShouldEqual, strings.Repeat("x", 40))
+			})
+		})
+
+		Convey("When a client is idle for too long", func() {
+			conn, _ := net.Dial("tcp", server.Addr().String())
+			defer conn.Close()
+
+			Convey("Then it is disconnected", func() {
+				select {
+				case stats := <-closed:
+					So(stats.Err, ShouldNotBeNil)
+				case <-time.After(2 * time.Second):
+					So("still connected", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("When more clients connect than allowed", func() {
+			first, _ := net.Dial("tcp", server.Addr().String())
+			defer first.Close()
+			first.Write([]byte(`{"first":1}` + "\x00"))
+			So(<-messages, ShouldEqual, `{"first":1}`)
+			second, _ := net.Dial("tcp", server.Addr().String())
+			defer second.Close()
+
+			Convey("Then the extra ones are disconnected right away", func() {
+				second.SetReadDeadline(time.Now().Add(time.Second))
+				_, err := second.Read(make([]byte, 1))
+				So(err, ShouldEqual, io.EOF)
+			})
+		})
+	})
+
+	Convey("Given a GELF TCP server with TLS", t, func() {
+		https := httptest.NewTLSServer(nil)
+		cert := https.TLS.Certificates[0]
+		https.Close()
+		server, messages, _ := serve(&tls.Config{Certificates: []tls.Certificate{cert}}, TCPOptions{})
+		defer server.Close()
+
+		Convey("When a client sends a message over TLS", func() {
+			conn, err := tls.Dial("tcp", server.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			conn.Write([]byte(message + "\x00"))
+
+			Convey("Then it is handled", func() {
+				So(<-messages, ShouldEqual, message)
+			})
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
@@ -8,13 +9,24 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/linhnh123/golang-microservices-tutorial/gelftail/aggregator"
+	"github.com/linhnh123/golang-microservices-tutorial/gelftail/gelf"
 	"github.com/linhnh123/golang-microservices-tutorial/gelftail/transformer"
 )
 
 var authToken = ""
 var port *string
+var chunkTimeout *time.Duration
+var maxPendingMessages *int
+var tcpPort *string
+var tcpCertFile *string
+var tcpKeyFile *string
+var tcpMaxConnections *int
+var tcpIdleTimeout *time.Duration
+var tcpMaxMessageSize *int
+var tcpConnectionMetrics *bool
 
 func init() {
 	data, err := ioutil.ReadFile("token.txt")
@@ -25,6 +37,15 @@ func init() {
 	}
 	authToken = string(data)
 	port = flag.String("port", "12202", "UDP port for gelftail")
+	chunkTimeout = flag.Duration("chunkTimeout", 5*time.Second, "How long to wait for all chunks of a chunked GELF message")
+	maxPendingMessages = flag.Int("maxPendingMessages", 1000, "How many chunked GELF messages can wait for chunks at a time")
+	tcpPort = flag.String("tcpPort", "12202", "TCP port for gelftail, empty to only listen on UDP")
+	tcpCertFile = flag.String("tcpCert", "", "PEM certificate file, to accept TCP connections over TLS")
+	tcpKeyFile = flag.String("tcpKey", "", "PEM private key file of the certificate")
+	tcpMaxConnections = flag.Int("tcpMaxConnections", 100, "How many TCP clients can be connected at a time")
+	tcpIdleTimeout = flag.Duration("tcpIdleTimeout", 5*time.Minute, "How long a TCP client can stay connected without sending anything")
+	tcpMaxMessageSize = flag.Int("tcpMaxMessageSize", 1<<20, "Most bytes a GELF message over TCP may have, clients sending larger ones are disconnected")
+	tcpConnectionMetrics = flag.Bool("tcpConnectionMetrics", false, "Log the messages and bytes received over every TCP connection when it closes")
 	flag.Parse()
 }
 
@@ -37,7 +58,17 @@ func main() {
 	var bulkQueue = make(chan []byte, 1)
 
 	go aggregator.Start(bulkQueue, authToken)
-	go listenForLogStatements(serverConn, bulkQueue)
+	go listenForLogStatements(serverConn, gelf.NewDecoder(*chunkTimeout, *maxPendingMessages), bulkQueue)
+	if *tcpPort != "" {
+		tcpServer := startTCPServer(*tcpPort)
+		defer tcpServer.Close()
+		go func() {
+			err := tcpServer.Serve(func(message []byte) {
+				handleLogStatement(message, bulkQueue)
+			})
+			log.Printf("Stopped listening for GELF over TCP: %v\n", err)
+		}()
+	}
 
 	log.Println("Started Gelf-tail server")
 
@@ -63,9 +94,8 @@ func startUDPServer(port string) *net.UDPConn {
 	return serverConn
 }
 
-func listenForLogStatements(serverConn *net.UDPConn, bulkQueue chan []byte) {
-	buf := make([]byte, 8192) // 8kb
-	var item map[string]interface{}
+func listenForLogStatements(serverConn *net.UDPConn, decoder *gelf.Decoder, bulkQueue chan []byte) {
+	buf := make([]byte, gelf.MaxDatagramSize)
 
 	for {
 		n, _, err := serverConn.ReadFromUDP(buf)
@@ -73,18 +103,56 @@ func listenForLogStatements(serverConn *net.UDPConn, bulkQueue chan []byte) {
 			log.Printf("Problem reading UDP message into buffer: %v\n", err.Error())
 			continue
 		}
-		err = json.Unmarshal(buf[0:n], &item)
+		message, err := decoder.Decode(buf[0:n])
 		if err != nil {
-			log.Printf("Problem unmarshalling log message into JSON: " + err.Error())
-			item = nil
+			log.Printf("Problem decoding GELF message: %v\n", err.Error())
 			continue
 		}
-		processedLogMessage, err := transformer.ProcessLogStatement(item)
-		if err != nil {
-			log.Printf("Problem parsing message: %v", string(buf[0:n]))
-		} else {
-			bulkQueue <- processedLogMessage
+		if message == nil {
+			continue // Waiting for more chunks
 		}
-		item = nil
+		handleLogStatement(message, bulkQueue)
+	}
+}
+
+func startTCPServer(port string) *gelf.TCPServer {
+	var tlsConfig *tls.Config
+	if *tcpCertFile != "" || *tcpKeyFile != "" {
+		var err error
+		tlsConfig, err = gelf.LoadTLSConfig(*tcpCertFile, *tcpKeyFile)
+		checkError(err)
+	}
+	opts := gelf.TCPOptions{
+		MaxConnections: *tcpMaxConnections,
+		IdleTimeout:    *tcpIdleTimeout,
+		MaxMessageSize: *tcpMaxMessageSize,
+	}
+	if *tcpConnectionMetrics {
+		opts.OnClose = logConnStats
+	}
+	server, err := gelf.ListenTCP(":"+port, tlsConfig, opts)
+	checkError(err)
+	log.Printf("Listening for GELF over TCP at %v, TLS: %v\n", server.Addr(), tlsConfig != nil)
+	return server
+}
+
+func logConnStats(stats gelf.ConnStats) {
+	log.Printf("GELF TCP connection from %v closed after %v: %v messages, %v bytes, error: %v\n",
+		stats.RemoteAddr, stats.Closed.Sub(stats.Opened), stats.Messages, stats.Bytes, stats.Err)
+}
+
+// handleLogStatement passes a GELF message on to the aggregator.
+func handleLogStatement(message []byte, bulkQueue chan []byte) {
+	var item map[string]interface{}
+	err := json.Unmarshal(message, &item)
+	if err != nil {
+		log.Printf("Problem unmarshalling log message into JSON: " + err.Error())
+		return
+	}
+	processedLogMessage, err := transformer.ProcessLogStatement(item)
+	if err != nil {
+		log.Printf("Problem parsing message: %v", string(message))
+	} else {
+		bulkQueue <- processedLogMessage
 	}
 }
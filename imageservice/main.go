@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"sync"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 	"github.com/linhnh123/golang-microservices-tutorial/imageservice/service"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -14,40 +20,164 @@ import (
 
 var appName = "imageservice"
 
+// appConfig is the configuration imageservice needs, validated at startup and on every refresh.
+type appConfig struct {
+	ServerPort          int    `config:"server_port" validate:"required,port"`
+	AmqpServerUrl       string `config:"amqp_server_url" validate:"required,url"`
+	ConfigEventBus      string `config:"config_event_bus" default:"springCloudBus"`
+	LogLevel            string `config:"log_level" validate:"oneof=trace|debug|info|warn|warning|error|fatal|panic"`
+	LogFormat           string `config:"log_format" default:"json" validate:"oneof=json|text"`
+	ImageJobConcurrency int    `config:"image_job_concurrency" default:"4" validate:"min=1,max=64"`
+	// Tracing is off unless a Zipkin server or another trace endpoint is configured.
+	ZipkinServerUrl    string   `config:"zipkin_server_url" validate:"url"`
+	TraceExporter      string   `config:"trace_exporter" default:"zipkin" validate:"oneof=zipkin|otel-zipkin|otlp|stdout|file"`
+	TraceEndpoint      string   `config:"trace_endpoint"`
+	TracePropagation   []string `config:"trace_propagation" default:"b3multi"`
+	TraceSampler       string   `config:"trace_sampler" default:"always"`
+	TraceSamplerRoutes []string `config:"trace_sampler_routes" default:"/health=never"`
+}
+
+// The configuration the service started with. It isn't changed by refreshes, use currentConfig.
+var cfg appConfig
+
+// Swapped to a new copy of appConfig by every valid refresh.
+var boundConfig *config.Binding
+
+// currentConfig returns the configuration as of the last valid refresh. It must not be changed.
+func currentConfig() *appConfig {
+	return boundConfig.Get().(*appConfig)
+}
+
+// Flushes the spans that haven't been exported yet.
+var stopTracing = func(ctx context.Context) error { return nil }
+
+// How long in-flight HTTP requests and messages get to finish when the service is stopped.
+var shutdownTimeout = 15 * time.Second
+
 func init() {
 	profile := flag.String("profile", "test", "Environment profile, something similar to spring profiles")
 	configServerUrl := flag.String("configServerUrl", "http://configserver:8888", "Address to config server")
 	configBranch := flag.String("configBranch", "master", "git branch to fetch configuration from")
+	offline := flag.Bool("offline", false, "Start without loading configuration from the config server")
+	configFile := flag.String("configFile", "", "Local YAML or JSON config file, overridden by the config server")
 
 	flag.Parse()
 
 	viper.Set("profile", *profile)
 	viper.Set("configServerUrl", *configServerUrl)
 	viper.Set("configBranch", *configBranch)
+	viper.Set("offline", *offline)
+	viper.Set("configFile", *configFile)
 }
 
 func main() {
-	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logging.Init(appName)
 	logrus.Infof("Starting %v", appName)
 
 	start := time.Now().UTC()
-	config.LoadConfigurationFromBranch(viper.GetString("configServerUrl"), appName, viper.GetString("profile"), viper.GetString("configBranch"))
+	err := config.Load(config.Options{
+		AppName:         appName,
+		Profile:         viper.GetString("profile"),
+		Branch:          viper.GetString("configBranch"),
+		ConfigServerUrl: viper.GetString("configServerUrl"),
+		Offline:         viper.GetBool("offline"),
+		ConfigFile:      viper.GetString("configFile"),
+	})
+	if err != nil {
+		logrus.Fatalf("Couldn't load configuration, cannot start: %v", err)
+	}
+	if boundConfig, err = config.Bind(&cfg); err != nil {
+		logrus.Fatalf("Invalid configuration, cannot start: %v", err)
+	}
+	logging.ManageConfig()
+	initializeTracing()
 	initializeMessaging()
-	go service.StartWebServer(viper.GetString("server_port")) // Starts HTTP service  (async)
+	go service.StartWebServer(strconv.Itoa(cfg.ServerPort)) // Starts HTTP service  (async)
 
 	logrus.Infof("Started %v in %v", appName, time.Now().UTC().Sub(start))
-	// Block...
-	wg := sync.WaitGroup{} // Use a WaitGroup to block main() exit
-	wg.Add(1)
-	wg.Wait()
+	// Block until we're told to stop
+	<-handleSigterm(func(ctx context.Context) {
+		if err := service.StopWebServer(ctx); err != nil {
+			logrus.Errorf("HTTP server did not shut down cleanly: %v", err)
+		}
+		if err := service.MessagingClient.Shutdown(ctx); err != nil {
+			logrus.Errorf("Messaging client did not shut down cleanly: %v", err)
+		}
+		if err := stopTracing(ctx); err != nil {
+			logrus.Errorf("Tracing did not shut down cleanly: %v", err)
+		}
+	})
+	logrus.Infof("%v stopped", appName)
 }
 
 func initializeMessaging() {
-	if !viper.IsSet("amqp_server_url") {
-		panic("No 'amqp_server_url' set in configuration, cannot start")
+	messaging.Producer = appName
+	service.MessagingClient = messaging.NewMessagingClient(cfg.AmqpServerUrl)
+	service.MessagingClient.ConnectToBroker(cfg.AmqpServerUrl)
+
+	topology, err := messaging.LoadTopology()
+	if err != nil {
+		panic("Could not load broker topology: " + err.Error())
 	}
+	if err := service.MessagingClient.DeclareTopology(topology); err != nil {
+		panic("Could not declare broker topology: " + err.Error())
+	}
+	service.MessagingClient.Subscribe(cfg.ConfigEventBus, "topic", appName,
+		config.RefreshEventHandler(service.MessagingClient, cfg.ConfigEventBus))
+
+	// Image processing jobs can also be requested over the broker, see messaging.RPCClient.
+	err = messaging.ServeRPC(service.MessagingClient, "imageservice.sepia", appName, cfg.ImageJobConcurrency, service.ProcessImageJob)
+	if err != nil {
+		panic("Could not serve image processing jobs: " + err.Error())
+	}
+}
+
+func initializeTracing() {
+	endpoint := cfg.TraceEndpoint
+	if endpoint == "" {
+		endpoint = cfg.ZipkinServerUrl
+	}
+	if endpoint == "" && cfg.TraceExporter != tracing.ExporterStdout {
+		logrus.Infof("No zipkin_server_url or trace_endpoint set, running without tracing")
+		return
+	}
+	var err error
+	stopTracing, err = tracing.Init(tracing.Options{ServiceName: appName, Exporter: cfg.TraceExporter, Endpoint: endpoint})
+	if err != nil {
+		logrus.Warnf("Running without tracing: %v", err)
+	}
+	if err := tracing.SetPropagation(tracing.ParseFormats(cfg.TracePropagation)...); err != nil {
+		logrus.Fatalf("Invalid trace propagation: %v", err)
+	}
+	if err := tracing.SetSampling(cfg.TraceSampler, cfg.TraceSamplerRoutes); err != nil {
+		logrus.Fatalf("Invalid trace sampling: %v", err)
+	}
+	config.Watch("trace_sampler", func(key string, oldValue interface{}, newValue interface{}) {
+		current := currentConfig()
+		if err := tracing.SetSampling(current.TraceSampler, current.TraceSamplerRoutes); err != nil {
+			logrus.Errorf("Keeping the current trace sampling: %v", err)
+		}
+	})
+	config.WatchString(tracing.PropagationConfigKey, func(oldValue string, newValue string) {
+		if err := tracing.SetPropagation(tracing.ParseFormats(currentConfig().TracePropagation)...); err != nil {
+			logrus.Errorf("Keeping the current trace propagation: %v", err)
+		}
+	})
+}
 
-	service.MessagingClient = &messaging.MessagingClient{}
-	service.MessagingClient.ConnectToBroker(viper.GetString("amqp_server_url"))
-	service.MessagingClient.Subscribe(viper.GetString("config_event_bus"), "topic", appName, config.HandleRefreshEvent)
+// handleSigterm runs handleExit once SIGINT or SIGTERM is received, with a context that expires
+// after shutdownTimeout. The returned channel is closed when handleExit has returned.
+func handleSigterm(handleExit func(ctx context.Context)) <-chan struct{} {
+	done := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, syscall.SIGTERM)
+	go func() {
+		<-c
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		handleExit(ctx)
+		close(done)
+	}()
+	return done
 }
@@ -2,13 +2,14 @@ package service
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"image"
 	"net/http"
 	"os"
 	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
 	"github.com/sirupsen/logrus"
 )
@@ -25,6 +26,20 @@ func ProcessImage(w http.ResponseWriter, r *http.Request) {
 	writeAndReturn(w, sourceImage)
 }
 
+// ProcessImageJob applies the sepia filter to an image received over the broker and replies with
+// the resulting JPEG.
+func ProcessImageJob(ctx context.Context, payload []byte) ([]byte, error) {
+	sourceImage, _, err := image.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := Sepia(sourceImage, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func GetAccountImage(w http.ResponseWriter, r *http.Request) {
 	data := []byte("http://imageservice:7777/file/cake.jpg")
 	w.Header().Set("Content-Type", "text/plain")
@@ -40,12 +55,12 @@ func ProcessImageFromFile(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	var filename = vars["filename"]
-	logrus.Println("Serving image for account: " + filename)
+	logging.FromContext(r.Context()).Println("Serving image for account: " + filename)
 
 	fImg1, err := os.Open("testimages/" + filename)
 	defer fImg1.Close()
 	if err != nil {
-		fmt.Println(err.Error())
+		logging.FromContext(r.Context()).Errorf("Couldn't open image %v: %v", filename, err)
 		return
 	}
 	sourceImage, _, err := image.Decode(fImg1)
@@ -62,7 +77,6 @@ func writeAndReturn(w http.ResponseWriter, sourceImage image.Image) {
 	err := Sepia(sourceImage, buf)
 
 	if err != nil {
-		fmt.Println(err.Error())
 		writeServerError(w, err.Error())
 		return
 	}
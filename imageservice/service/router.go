@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 )
 
 func NewRouter() *mux.Router {
@@ -20,5 +22,6 @@ func NewRouter() *mux.Router {
 			Name(route.Name).
 			Handler(handler)
 	}
+	router.Use(logging.RequestIDMiddleware, tracing.HTTPMiddleware)
 	return router
 }
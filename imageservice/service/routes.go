@@ -1,6 +1,10 @@
 package service
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+)
 
 type Route struct {
 	Name        string
@@ -40,4 +44,16 @@ var routes = Routes{
 			w.Write([]byte("OK"))
 		},
 	},
+	Route{
+		"AdminConfig",
+		"GET",
+		"/admin/config",
+		config.AdminOnly(config.ConfigHandler),
+	},
+	Route{
+		"AdminConfigRefresh",
+		"POST",
+		"/admin/config/refresh",
+		config.AdminOnly(config.RefreshHandler),
+	},
 }
@@ -1,20 +1,31 @@
 package service
 
 import (
-	"log"
+	"context"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
 )
 
-func StartWebServer(port string) {
+var server = &http.Server{}
+
+// StartWebServer serves HTTP on port until StopWebServer is called, in which case it returns nil.
+func StartWebServer(port string) error {
 
 	r := NewRouter()
 	http.Handle("/", r)
 	logrus.Infof("Starting HTTP service at %s", port)
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		log.Println("An error occured starting HTTP listener at port " + port)
-		log.Println("Error: " + err.Error())
+	server.Addr = ":" + port
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logrus.Errorf("Couldn't start HTTP listener at port %v: %v", port, err)
+		return err
 	}
+	return nil
+}
+
+// StopWebServer stops accepting new connections and waits for active requests to complete, or for
+// ctx to expire.
+func StopWebServer(ctx context.Context) error {
+	return server.Shutdown(ctx)
 }
@@ -17,7 +17,6 @@ docker service rm accountservice
 docker service create \
 --log-driver=gelf \
 --log-opt gelf-address=udp://192.168.99.100:12202 \
---log-opt gelf-compression-type=none \
 --name=accountservice --replicas=1 --network=my_network -p=6767:6767 linhnh123/accountservice
 
 docker build -t linhnh123/vipservice vipservice/
@@ -25,7 +24,6 @@ docker service rm vipservice
 docker service create \
 --log-driver=gelf \
 --log-opt gelf-address=udp://192.168.99.100:12202 \
---log-opt gelf-compression-type=none \
 --name=vipservice --replicas=1 --network=my_network linhnh123/vipservice
 
 docker build -t linhnh123/imageservice imageservice/
@@ -33,5 +31,4 @@ docker service rm imageservice
 docker service create \
 --log-driver=gelf \
 --log-opt gelf-address=udp://192.168.99.100:12202 \
---log-opt gelf-compression-type=none \
 --name=imageservice --replicas=1 --network=my_network -p=7777:7777 linhnh123/imageservice
\ No newline at end of file
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/linhnh123/golang-microservices-tutorial/common/config"
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
+	"github.com/linhnh123/golang-microservices-tutorial/common/tracing"
 	"github.com/linhnh123/golang-microservices-tutorial/vipservice/service"
-	"github.com/streadway/amqp"
 
 	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -20,66 +23,167 @@ var appName = "vipservice"
 
 var messagingClient messaging.IMessagingClient
 
+// appConfig is the configuration vipservice needs, validated at startup and on every refresh.
+type appConfig struct {
+	ServerPort      int    `config:"server_port" validate:"required,port"`
+	AmqpServerUrl   string `config:"amqp_server_url" validate:"required,url"`
+	ConfigEventBus  string `config:"config_event_bus" default:"springCloudBus"`
+	ZipkinServerUrl string `config:"zipkin_server_url" validate:"required,url"`
+	// One of the tracing.Exporter constants, with the Zipkin server as endpoint unless set.
+	TraceExporter string `config:"trace_exporter" default:"zipkin" validate:"oneof=zipkin|otel-zipkin|otlp|stdout|file"`
+	TraceEndpoint string `config:"trace_endpoint"`
+	// Trace context formats for HTTP and AMQP headers, see tracing.SetPropagation.
+	TracePropagation []string `config:"trace_propagation" default:"b3multi"`
+	// How new traces are sampled, see tracing.SetSampling.
+	TraceSampler       string   `config:"trace_sampler" default:"always"`
+	TraceSamplerRoutes []string `config:"trace_sampler_routes" default:"/health=never"`
+	LogLevel           string   `config:"log_level" validate:"oneof=trace|debug|info|warn|warning|error|fatal|panic"`
+	LogFormat          string   `config:"log_format" default:"json" validate:"oneof=json|text"`
+}
+
+// The configuration the service started with. It isn't changed by refreshes, use currentConfig.
+var cfg appConfig
+
+// Swapped to a new copy of appConfig by every valid refresh.
+var boundConfig *config.Binding
+
+// currentConfig returns the configuration as of the last valid refresh. It must not be changed.
+func currentConfig() *appConfig {
+	return boundConfig.Get().(*appConfig)
+}
+
+// Flushes the spans that haven't been exported yet.
+var stopTracing = func(ctx context.Context) error { return nil }
+
+// How long in-flight HTTP requests and messages get to finish when the service is stopped.
+var shutdownTimeout = 15 * time.Second
+
 func init() {
 	configServerUrl := flag.String("configServerUrl", "http://configserver:8888", "Address to config server")
 	profile := flag.String("profile", "test", "Environment profile, something similar to spring profiles")
 	configBranch := flag.String("configBranch", "master", "git branch to fetch configuration from")
+	offline := flag.Bool("offline", false, "Start without loading configuration from the config server")
+	configFile := flag.String("configFile", "", "Local YAML or JSON config file, overridden by the config server")
 	flag.Parse()
 
 	viper.Set("profile", *profile)
 	viper.Set("configServerUrl", *configServerUrl)
 	viper.Set("configBranch", *configBranch)
+	viper.Set("offline", *offline)
+	viper.Set("configFile", *configFile)
 }
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Printf("%s: %s", msg, err)
-		panic(fmt.Sprintf("%s: %s", msg, err))
+		logrus.Panicf("%s: %s", msg, err)
 	}
 }
 
-func onMessage(delivery amqp.Delivery) {
-	log.Printf("Got a message: %v\n", string(delivery.Body))
-}
-
 func initializeMessaging() {
-	if !viper.IsSet("amqp_server_url") {
-		panic("No 'broker_url' set in configuration, cannot start")
-	}
-	messagingClient = &messaging.MessagingClient{}
-	messagingClient.ConnectToBroker(viper.GetString("amqp_server_url"))
+	messaging.Producer = appName
+	messagingClient = messaging.NewMessagingClient(cfg.AmqpServerUrl)
+	messagingClient.ConnectToBroker(cfg.AmqpServerUrl)
+
+	topology, err := messaging.LoadTopology()
+	failOnError(err, "Could not load broker topology")
+	err = messagingClient.DeclareTopology(topology)
+	failOnError(err, "Could not declare broker topology")
 
 	// Call the subscribe method with queue name and callback function
-	err := messagingClient.SubscribeToQueue("vipQueue", appName, onMessage)
-	failOnError(err, "Could not start subscribe to vipQueue")
+	err = service.SubscribeToVipNotifications(messagingClient, appName)
+	failOnError(err, "Could not start subscribe to "+service.VipQueue)
 
-	err = messagingClient.Subscribe(viper.GetString("config_event_bus"), "topic", appName, config.HandleRefreshEvent)
-	failOnError(err, "Could not start subscribe to "+viper.GetString("config_event_bus")+" topic")
+	err = messagingClient.Subscribe(cfg.ConfigEventBus, "topic", appName,
+		config.RefreshEventHandler(messagingClient, cfg.ConfigEventBus))
+	failOnError(err, "Could not start subscribe to "+cfg.ConfigEventBus+" topic")
 }
 
 func main() {
-	log.Println("Starting " + appName + "...")
-
-	config.LoadConfigurationFromBranch(viper.GetString("configServerUrl"), appName, viper.GetString("profile"), viper.GetString("configBranch"))
+	logging.Init(appName)
+	logrus.Infof("Starting %v", appName)
+
+	err := config.Load(config.Options{
+		AppName:         appName,
+		Profile:         viper.GetString("profile"),
+		Branch:          viper.GetString("configBranch"),
+		ConfigServerUrl: viper.GetString("configServerUrl"),
+		Offline:         viper.GetBool("offline"),
+		ConfigFile:      viper.GetString("configFile"),
+		Defaults: map[string]interface{}{
+			messaging.TopologyConfigKey + ".queues.vip.name": service.VipQueue,
+		},
+	})
+	failOnError(err, "Couldn't load configuration, cannot start")
+	boundConfig, err = config.Bind(&cfg)
+	failOnError(err, "Invalid configuration, cannot start")
 
+	logging.ManageConfig()
+	initializeTracing()
 	initializeMessaging()
 
-	handleSigterm(func() {
+	shutdownComplete := handleSigterm(func(ctx context.Context) {
+		if err := service.StopWebServer(ctx); err != nil {
+			logrus.Errorf("HTTP server did not shut down cleanly: %v", err)
+		}
 		if messagingClient != nil {
-			messagingClient.Close()
+			if err := messagingClient.Shutdown(ctx); err != nil {
+				logrus.Errorf("Messaging client did not shut down cleanly: %v", err)
+			}
+		}
+		if err := stopTracing(ctx); err != nil {
+			logrus.Errorf("Tracing did not shut down cleanly: %v", err)
 		}
 	})
 
-	service.StartWebServer(viper.GetString("server_port"))
+	if err := service.StartWebServer(strconv.Itoa(cfg.ServerPort)); err != nil {
+		os.Exit(1)
+	}
+	<-shutdownComplete
+	logrus.Infof("%v stopped", appName)
 }
 
-func handleSigterm(handleExit func()) {
+func initializeTracing() {
+	endpoint := cfg.TraceEndpoint
+	if endpoint == "" {
+		endpoint = cfg.ZipkinServerUrl
+	}
+	var err error
+	stopTracing, err = tracing.Init(tracing.Options{ServiceName: appName, Exporter: cfg.TraceExporter, Endpoint: endpoint})
+	if err != nil {
+		logrus.Warnf("Running without tracing: %v", err)
+	}
+	if err := tracing.SetPropagation(tracing.ParseFormats(cfg.TracePropagation)...); err != nil {
+		failOnError(err, "Invalid trace propagation")
+	}
+	if err := tracing.SetSampling(cfg.TraceSampler, cfg.TraceSamplerRoutes); err != nil {
+		failOnError(err, "Invalid trace sampling")
+	}
+	config.Watch("trace_sampler", func(key string, oldValue interface{}, newValue interface{}) {
+		current := currentConfig()
+		if err := tracing.SetSampling(current.TraceSampler, current.TraceSamplerRoutes); err != nil {
+			logrus.Errorf("Keeping the current trace sampling: %v", err)
+		}
+	})
+	config.WatchString(tracing.PropagationConfigKey, func(oldValue string, newValue string) {
+		if err := tracing.SetPropagation(tracing.ParseFormats(currentConfig().TracePropagation)...); err != nil {
+			logrus.Errorf("Keeping the current trace propagation: %v", err)
+		}
+	})
+}
+
+// handleSigterm runs handleExit once SIGINT or SIGTERM is received, with a context that expires
+// after shutdownTimeout. The returned channel is closed when handleExit has returned.
+func handleSigterm(handleExit func(ctx context.Context)) <-chan struct{} {
+	done := make(chan struct{})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 	go func() {
 		<-c
-		handleExit()
-		os.Exit(1)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		handleExit(ctx)
+		close(done)
 	}()
+	return done
 }
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+
+	"github.com/linhnh123/golang-microservices-tutorial/common/logging"
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/linhnh123/golang-microservices-tutorial/common/model"
+)
+
+// VipQueue is where accountservice publishes a VipNotification when a VIP account is read.
+const VipQueue = "vipQueue"
+
+func init() {
+	messaging.RegisterMessageType("VipNotification", 1, model.VipNotification{})
+}
+
+// SubscribeToVipNotifications passes the notifications on VipQueue to OnVipNotification.
+func SubscribeToVipNotifications(client messaging.IMessagingClient, consumerName string) error {
+	return messaging.SubscribeTypedToQueue(client, VipQueue, consumerName, OnVipNotification)
+}
+
+// OnVipNotification logs which VIP account was read, and when.
+func OnVipNotification(ctx context.Context, envelope messaging.Envelope, payload interface{}) {
+	notification := payload.(*model.VipNotification)
+	logging.FromContext(ctx).Infof("Got a %v message from %v: VIP account %v read at %v",
+		envelope.Type, envelope.Producer, notification.AccountId, notification.ReadAt)
+}
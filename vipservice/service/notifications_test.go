@@ -0,0 +1,67 @@
+package service
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linhnh123/golang-microservices-tutorial/accountservice/dbclient"
+	accountmodel "github.com/linhnh123/golang-microservices-tutorial/accountservice/model"
+	accountservice "github.com/linhnh123/golang-microservices-tutorial/accountservice/service"
+	cb "github.com/linhnh123/golang-microservices-tutorial/common/circuitbreaker"
+	"github.com/linhnh123/golang-microservices-tutorial/common/messaging"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/h2non/gock.v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// loggedWithin reports whether an entry containing text is logged before timeout.
+func loggedWithin(hook *test.Hook, text string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, entry := range hook.AllEntries() {
+			if strings.Contains(entry.Message, text) {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestVipNotificationFromAccountservice(t *testing.T) {
+	Convey("Given accountservice and vipservice sharing an in-memory broker instead of RabbitMQ", t, func() {
+		broker := messaging.NewMessagingClient(messaging.InMemoryBrokerURL)
+		broker.ConnectToBroker(messaging.InMemoryBrokerURL)
+		defer broker.Close()
+		So(SubscribeToVipNotifications(broker, "vipservice"), ShouldBeNil)
+		accountservice.MessagingClient = broker
+
+		db := &dbclient.MockBoltClient{}
+		db.On("QueryAccount", mock.Anything, "10000").Return(accountmodel.Account{Id: "10000", Name: "Person_10000"}, nil)
+		accountservice.DBClient = db
+
+		gock.InterceptClient(&cb.Client)
+		defer gock.RestoreClient(&cb.Client)
+		defer gock.Off()
+		gock.New("http://quotes-service:8080").Get("/api/quote").
+			Reply(200).BodyString(`{"quote":"May the source be with you. Always","language":"en"}`)
+		gock.New("http://imageservice:7777").Get("/accounts/10000").
+			Reply(200).BodyString(`{"id":"10000","url":"http://imageservice:7777/file/cake.jpg","servedBy":"imageservice"}`)
+
+		hook := test.NewGlobal()
+
+		Convey("When the VIP account is read from accountservice", func() {
+			resp := httptest.NewRecorder()
+			accountservice.NewRouter().ServeHTTP(resp, httptest.NewRequest("GET", "/accounts/10000", nil))
+
+			Convey("Then vipservice handles the notification accountservice published", func() {
+				So(resp.Code, ShouldEqual, 200)
+				So(loggedWithin(hook, "VIP account 10000 read", time.Second), ShouldBeTrue)
+			})
+		})
+	})
+}
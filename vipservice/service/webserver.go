@@ -1,19 +1,32 @@
 package service
 
 import (
-	"log"
+	"context"
 	"net/http"
+
+	"github.com/sirupsen/logrus"
 )
 
-func StartWebServer(port string) {
+var server = &http.Server{}
+
+// StartWebServer serves HTTP on port until StopWebServer is called, in which case it returns nil.
+func StartWebServer(port string) error {
 	r := NewRouter()
 	http.Handle("/", r)
 
-	log.Println("Starting HTTP service at " + port)
-	err := http.ListenAndServe(":"+port, nil)
+	logrus.Infof("Starting HTTP service at %v", port)
+	server.Addr = ":" + port
+	err := server.ListenAndServe()
 
-	if err != nil {
-		log.Println("An error occured starting HTTP listener at port " + port)
-		log.Println("Error: " + err.Error())
+	if err != nil && err != http.ErrServerClosed {
+		logrus.Errorf("Couldn't start HTTP listener at port %v: %v", port, err)
+		return err
 	}
+	return nil
+}
+
+// StopWebServer stops accepting new connections and waits for active requests to complete, or for
+// ctx to expire.
+func StopWebServer(ctx context.Context) error {
+	return server.Shutdown(ctx)
 }